@@ -0,0 +1,130 @@
+package go_net
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/hezhis/go_log"
+)
+
+type (
+	// Backoff decides how long a client waits before the next connect attempt.
+	// attempt counts consecutive failures and starts from 1, ok reports false
+	// once the client should give up.
+	Backoff interface {
+		Next(attempt int) (delay time.Duration, ok bool)
+	}
+
+	ConstantBackoff struct {
+		Interval    time.Duration
+		MaxAttempts int // <= 0 means retry forever
+	}
+
+	ExponentialBackoff struct {
+		Initial     time.Duration
+		Max         time.Duration
+		Multiplier  float64
+		Jitter      float64 // 0..1, part of the delay which is randomized
+		MaxAttempts int     // <= 0 means retry forever
+	}
+
+	RetryParam struct {
+		pBackoff    Backoff
+		nResetAfter time.Duration
+
+		onDialError func(addr string, attempt int, err error)
+		onGiveUp    func(attempts int, lastErr error)
+	}
+
+	retryState struct {
+		pParam   *RetryParam
+		nAttempt int
+		pLastErr error
+	}
+)
+
+var (
+	jitterRand   = rand.New(rand.NewSource(time.Now().UnixNano()))
+	jitterLocker sync.Mutex
+)
+
+func (b *ConstantBackoff) Next(attempt int) (time.Duration, bool) {
+	if b.MaxAttempts > 0 && attempt >= b.MaxAttempts {
+		return 0, false
+	}
+	return b.Interval, true
+}
+
+func (b *ExponentialBackoff) Next(attempt int) (time.Duration, bool) {
+	if b.MaxAttempts > 0 && attempt >= b.MaxAttempts {
+		return 0, false
+	}
+
+	initial := b.Initial
+	if initial <= 0 {
+		initial = 100 * time.Millisecond
+	}
+	max := b.Max
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+
+	delay := float64(initial) * math.Pow(multiplier, float64(attempt-1))
+	if delay > float64(max) {
+		delay = float64(max)
+	}
+
+	if jitter := b.Jitter; jitter > 0 {
+		if jitter > 1 {
+			jitter = 1
+		}
+		jitterLocker.Lock()
+		r := jitterRand.Float64()
+		jitterLocker.Unlock()
+		delay -= delay * jitter * r
+	}
+
+	return time.Duration(delay), true
+}
+
+func newRetryState(param *RetryParam) *retryState {
+	return &retryState{pParam: param}
+}
+
+// dialFailed records a failed dial and returns how long to wait before the next one.
+func (r *retryState) dialFailed(addr string, err error) (time.Duration, bool) {
+	r.nAttempt++
+	r.pLastErr = err
+	if nil != r.pParam.onDialError {
+		r.pParam.onDialError(addr, r.nAttempt, err)
+	}
+	return r.next()
+}
+
+// disconnected is called when an established connection is lost. Connections
+// that stayed up for at least nResetAfter start the backoff from scratch.
+func (r *retryState) disconnected(uptime time.Duration) (time.Duration, bool) {
+	if uptime >= r.pParam.nResetAfter {
+		r.nAttempt = 0
+		r.pLastErr = nil
+	}
+	r.nAttempt++
+	return r.next()
+}
+
+func (r *retryState) next() (time.Duration, bool) {
+	delay, ok := r.pParam.pBackoff.Next(r.nAttempt)
+	if !ok {
+		logger.Error("give up connecting after %v attempts, last error: %v", r.nAttempt, r.pLastErr)
+		if nil != r.pParam.onGiveUp {
+			r.pParam.onGiveUp(r.nAttempt, r.pLastErr)
+		}
+	}
+	return delay, ok
+}
@@ -0,0 +1,42 @@
+package go_net
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var ErrClientClosed = errors.New("client closed")
+
+// Client is implemented by the clients of every transport, the agents only
+// see the transport through Connector.
+type Client interface {
+	SetNewAgent(newAgent func(Connector) Agent)
+	Start()
+	StartContext(ctx context.Context)
+	WaitConnected(ctx context.Context) error
+	Send(args ...[]byte) error
+	Close()
+}
+
+var (
+	_ Client = (*TcpClient)(nil)
+	_ Client = (*WSClient)(nil)
+)
+
+// sleepContext waits for d and reports false if ctx ends first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return nil == ctx.Err()
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -9,12 +9,12 @@ import (
 )
 
 func main() {
-	s := go_net.NewTcpServer(
+	var s go_net.Server = go_net.NewTcpServer(
 		go_net.TcpSLocalAddr("127.0.0.1:6321"),
 		go_net.TcpSHeadLen(2),
 		go_net.TcpSMaxClientCount(2),
 	)
-	s.NewAgent = func(connector *go_net.TcpConnector) go_net.Agent {
+	s.SetNewAgent(func(connector go_net.Connector) go_net.Agent {
 		agent := &Agent{conn: connector}
 		logger.Info("new agent remote addr:%v", agent.conn.RemoteAddr())
 		MsgChan <- ChanMsgArgs{
@@ -22,7 +22,7 @@ func main() {
 			Param: agent,
 		}
 		return agent
-	}
+	})
 	s.Start()
 
 	c := make(chan os.Signal, 1)
@@ -32,8 +32,8 @@ out:
 	for {
 		select {
 		case sig := <-c:
-			break out
 			logger.Info("close by signal:%v", sig)
+			break out
 		case msg := <-MsgChan:
 			switch msg.Id {
 			case "NewAgent":
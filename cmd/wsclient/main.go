@@ -13,17 +13,17 @@ import (
 
 func main() {
 	rand.Seed(time.Now().UnixMicro())
-	client := go_net.NewWSClient(
+	var client go_net.Client = go_net.NewWSClient(
 		go_net.WSCRemoteAddr("ws://127.0.0.1:6321"),
 		go_net.WSCAutoReconnect(true),
 	)
 
-	var agent *Agent
-	client.NewAgent = func(connector *go_net.WSConnector) go_net.Agent {
-		agent = &Agent{conn: connector, name: strconv.Itoa(rand.Int())}
+	name := strconv.Itoa(rand.Int())
+	client.SetNewAgent(func(connector go_net.Connector) go_net.Agent {
+		agent := &Agent{conn: connector, name: name}
 		logger.Info("new agent remote addr:%v", agent.conn.LocalAddr())
 		return agent
-	}
+	})
 	client.Start()
 
 	c := make(chan os.Signal, 1)
@@ -38,9 +38,7 @@ out:
 			logger.Info("close by signal:%v", sig)
 			break out
 		case <-ticker.C:
-			if nil != agent && nil != agent.conn {
-				agent.conn.WriteMsg([]byte("my name's " + agent.name))
-			}
+			client.Send([]byte("my name's " + name))
 		}
 	}
 
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/hezhis/go_log"
+	"github.com/hezhis/go_net"
+)
+
+type (
+	// Agent bridges a websocket session to a backend connection of its own,
+	// or to a session on a gate link when the gateway multiplexes.
+	Agent struct {
+		conn    *go_net.WSConnector
+		backend *go_net.TcpClient
+		session *go_net.GateSession
+	}
+
+	backendAgent struct {
+		conn    go_net.Connector
+		session *Agent
+	}
+)
+
+var (
+	nActive int64
+	nTotal  int64
+)
+
+func newAgent(conn *go_net.WSConnector) *Agent {
+	agent := &Agent{conn: conn}
+	if nil != gate {
+		return agent
+	}
+
+	agent.backend = go_net.NewTcpClient(
+		go_net.TcpCRemoteAddr(*backendAddr),
+		go_net.TcpCReadHeadLen(*headLen),
+		go_net.TcpCLittleEndian(*littleEndian),
+		go_net.TcpCMaxMsgLen(uint32(*maxMsgLen)),
+		go_net.TcpCDialTimeout(*dialTimeout),
+	)
+	agent.backend.SetNewAgent(func(connector go_net.Connector) go_net.Agent {
+		return &backendAgent{conn: connector, session: agent}
+	})
+	return agent
+}
+
+func (agent *Agent) LogicRun() {
+	atomic.AddInt64(&nActive, 1)
+	atomic.AddInt64(&nTotal, 1)
+	defer atomic.AddInt64(&nActive, -1)
+
+	if err := agent.connect(); nil != err {
+		logger.Error("connect backend for %v: %v", agent.conn.RemoteAddr(), err)
+		agent.conn.CloseWithCode(go_net.WSCloseTryAgainLater, "backend unavailable")
+		return
+	}
+
+	for {
+		msgType, data, err := agent.conn.ReadMsgType()
+		if nil != err {
+			break
+		}
+		if msgType != go_net.WSBinaryMessage {
+			agent.conn.CloseWithCode(go_net.WSCloseUnsupportedData, "binary messages only")
+			break
+		}
+		if err := agent.send(data); nil != err {
+			logger.Error("send to backend:%v", err)
+			agent.conn.CloseWithCode(go_net.WSCloseInternalServerErr, "backend write failed")
+			break
+		}
+	}
+}
+
+// connect opens the backend side of the session.
+func (agent *Agent) connect() error {
+	if nil != gate {
+		session, err := gate.Open(agent.conn.RemoteAddr())
+		if nil != err {
+			return err
+		}
+		agent.session = session
+
+		go func() {
+			backend := &backendAgent{conn: session, session: agent}
+			backend.LogicRun()
+			backend.OnClose()
+		}()
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *dialTimeout)
+	defer cancel()
+	agent.backend.Start()
+	return agent.backend.WaitConnected(ctx)
+}
+
+func (agent *Agent) send(data []byte) error {
+	if nil != agent.session {
+		return agent.session.WriteMsg(data)
+	}
+	return agent.backend.Send(data)
+}
+
+func (agent *Agent) OnClose() {
+	if nil != agent.session {
+		agent.session.Close()
+	}
+	if nil != agent.backend {
+		agent.backend.Close()
+	}
+}
+
+func (agent *backendAgent) LogicRun() {
+	for {
+		data, err := agent.conn.ReadMsg()
+		if nil != err {
+			break
+		}
+		if err := agent.session.conn.WriteBinary(data); nil != err {
+			logger.Error("write to %v:%v", agent.session.conn.RemoteAddr(), err)
+			break
+		}
+	}
+}
+
+// OnClose ends the websocket session once the backend is gone.
+func (agent *backendAgent) OnClose() {
+	agent.session.conn.CloseWithCode(go_net.WSCloseGoingAway, "backend closed")
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hezhis/go_log"
+	"github.com/hezhis/go_net"
+)
+
+var (
+	listenAddr   = flag.String("listen", "127.0.0.1:6320", "websocket listen addr")
+	path         = flag.String("path", "", "websocket path, empty serves every path")
+	origins      = flag.String("origins", "", "comma separated allowed origins, empty allows the same origin only")
+	maxClients   = flag.Int("maxclients", 1000, "max websocket sessions")
+	backendAddr  = flag.String("backend", "127.0.0.1:6321", "tcp backend addr")
+	headLen      = flag.Int("head", 2, "length prefix size of the backend frames, 2 or 4")
+	littleEndian = flag.Bool("le", false, "little endian length prefix")
+	maxMsgLen    = flag.Int("maxmsg", 4096, "max message length")
+	dialTimeout  = flag.Duration("dialtimeout", 5*time.Second, "backend dial timeout")
+	links        = flag.Int("links", 0, "multiplex the sessions over this many links to a gate server, 0 connects every session on its own")
+	grace        = flag.Duration("grace", 10*time.Second, "time the sessions get to end on shutdown")
+	adminAddr    = flag.String("admin", "", "addr of the health and status endpoints, empty serves them on the listen addr")
+)
+
+// gate carries the sessions when they are multiplexed
+var gate *go_net.GateClient
+
+func main() {
+	flag.Parse()
+
+	if *links > 0 {
+		gate = go_net.NewGateClient(
+			go_net.TcpCRemoteAddr(*backendAddr),
+			go_net.TcpCReadHeadLen(*headLen),
+			go_net.TcpCLittleEndian(*littleEndian),
+			go_net.TcpCMaxMsgLen(uint32(*maxMsgLen+go_net.GateHeadLength)),
+			go_net.TcpCDialTimeout(*dialTimeout),
+			go_net.TcpCConnCount(*links),
+			go_net.TcpCAutoReconnect(true),
+		)
+		gate.Start()
+	}
+
+	opts := []go_net.WSServerOption{
+		go_net.WSSLocalAddr(*listenAddr),
+		go_net.WSSMaxClientCount(*maxClients),
+		go_net.WSSMaxMsgLen(uint32(*maxMsgLen)),
+		go_net.WSSHealth(go_net.HealthAdminAddr(*adminAddr)),
+	}
+	if *path != "" {
+		opts = append(opts, go_net.WSSPath(*path))
+	}
+	if *origins != "" {
+		opts = append(opts, go_net.WSSAllowedOrigins(strings.Split(*origins, ",")...))
+	}
+
+	s := go_net.NewWSServer(opts...)
+	s.NewAgent = func(conn *go_net.WSConnector) go_net.Agent {
+		return newAgent(conn)
+	}
+	s.Start()
+	logger.Info("gateway %v -> %v", *listenAddr, *backendAddr)
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, os.Kill)
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+out:
+	for {
+		select {
+		case sig := <-c:
+			logger.Info("close by signal:%v", sig)
+			break out
+		case <-ticker.C:
+			logger.Info("sessions active:%v total:%v", atomic.LoadInt64(&nActive), atomic.LoadInt64(&nTotal))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *grace)
+	defer cancel()
+	if err := s.Shutdown(ctx); nil != err {
+		logger.Info("sessions closed after grace period:%v", err)
+	}
+	if nil != gate {
+		gate.Close()
+	}
+	logger.Info("gateway stopped, sessions total:%v", atomic.LoadInt64(&nTotal))
+}
@@ -1,6 +1,16 @@
 package go_net
 
-import "net"
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// roomQueued bounds the messages a writer waiting for room leaves in a write
+// queue.
+const roomQueued = 8
+
+var ErrConnClosed = errors.New("connection closed")
 
 type Connector interface {
 	ReadMsg() ([]byte, error)
@@ -10,3 +20,61 @@ type Connector interface {
 	Close()
 	Destroy()
 }
+
+// StreamConnector reads and writes messages too large to be held in memory at
+// once. A stream must be read to its end before the next message and only one
+// stream may be written at a time.
+type StreamConnector interface {
+	Connector
+	ReadStream() (io.Reader, error)
+	WriteStream() StreamWriter
+}
+
+// StreamWriter writes a stream, Close ends it and CloseWithError aborts it so
+// the reader of the peer fails instead of seeing a complete message.
+type StreamWriter interface {
+	io.WriteCloser
+	CloseWithError(err error) error
+}
+
+// roomWaiter is a connector with a write queue, waitRoom blocks while the
+// queue is backed up and fails once the connection is closed.
+type roomWaiter interface {
+	waitRoom() error
+}
+
+func roomQueueLength(queueCap int) int {
+	if queueCap < roomQueued {
+		return queueCap
+	}
+	return roomQueued
+}
+
+// notifyDrained wakes a writer waiting for room in a write queue.
+func notifyDrained(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// drainedOpen fails once the writer closed ch on exit, a pending wake up is
+// left for the other waiters.
+func drainedOpen(ch chan struct{}) error {
+	select {
+	case _, ok := <-ch:
+		if !ok {
+			return ErrConnClosed
+		}
+		notifyDrained(ch)
+	default:
+	}
+	return nil
+}
+
+var (
+	_ roomWaiter      = (*TcpConnector)(nil)
+	_ roomWaiter      = (*WSConnector)(nil)
+	_ StreamConnector = (*TcpConnector)(nil)
+	_ StreamConnector = (*WSConnector)(nil)
+)
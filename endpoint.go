@@ -0,0 +1,194 @@
+package go_net
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/hezhis/go_log"
+)
+
+type BalanceStrategy int
+
+const (
+	BalanceFailover BalanceStrategy = iota + 1 // first endpoint not ejected in list order, the rest are backups
+	BalanceRoundRobin
+	BalanceLeastConn
+	BalanceRandom
+)
+
+type (
+	// EndpointParam holds the endpoints of a client. An endpoint is ejected
+	// after nEjectFailures consecutive failed dials, a failed handshake
+	// counts as a failed dial. Errors of established connections are not
+	// taken into account.
+	EndpointParam struct {
+		asAddrs   []string
+		pResolver Resolver
+		nStrategy BalanceStrategy
+
+		nEjectFailures int
+		nEjectDuration time.Duration
+	}
+
+	endpoint struct {
+		sAddr     string
+		nActive   int
+		nFailures int
+		tEjected  time.Time
+	}
+
+	endpointSet struct {
+		pParam *EndpointParam
+
+		locker    sync.Mutex
+		endpoints []*endpoint
+		nNext     int
+		rnd       *rand.Rand
+	}
+)
+
+func newEndpointSet(param *EndpointParam) *endpointSet {
+	if param.nStrategy < BalanceFailover || param.nStrategy > BalanceRandom {
+		param.nStrategy = BalanceRoundRobin
+	}
+	if param.nEjectFailures <= 0 {
+		param.nEjectFailures = 3
+	}
+	if param.nEjectDuration <= 0 {
+		param.nEjectDuration = 30 * time.Second
+	}
+
+	s := &endpointSet{
+		pParam: param,
+		rnd:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	s.update(param.asAddrs)
+	return s
+}
+
+// update replaces the endpoint list, keeping the state of addresses which are still present.
+func (s *endpointSet) update(addrs []string) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	old := make(map[string]*endpoint, len(s.endpoints))
+	for _, ep := range s.endpoints {
+		old[ep.sAddr] = ep
+	}
+
+	endpoints := make([]*endpoint, 0, len(addrs))
+	for _, addr := range addrs {
+		if ep, ok := old[addr]; ok {
+			endpoints = append(endpoints, ep)
+			delete(old, addr)
+			continue
+		}
+		endpoints = append(endpoints, &endpoint{sAddr: addr})
+	}
+	s.endpoints = endpoints
+}
+
+// resolve refreshes the endpoint list from the resolver, the old list is kept
+// if the resolver fails or returns nothing.
+func (s *endpointSet) resolve(ctx context.Context) {
+	if nil == s.pParam.pResolver {
+		return
+	}
+
+	addrs, err := s.pParam.pResolver.Resolve(ctx)
+	if nil != err {
+		logger.Error("resolve endpoints error: %v", err)
+		return
+	}
+	if len(addrs) == 0 {
+		logger.Warn("resolver returned no endpoint")
+		return
+	}
+	s.update(addrs)
+}
+
+// pick selects the endpoint for the next dial and counts the dial as an active
+// connection of it. Ejected endpoints are skipped unless every endpoint is
+// ejected, then the one released soonest is used.
+func (s *endpointSet) pick() *endpoint {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	ep := s.doPick()
+	if nil != ep {
+		ep.nActive++
+	}
+	return ep
+}
+
+func (s *endpointSet) doPick() *endpoint {
+	if len(s.endpoints) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	usable := make([]*endpoint, 0, len(s.endpoints))
+	for _, ep := range s.endpoints {
+		if !now.Before(ep.tEjected) {
+			usable = append(usable, ep)
+		}
+	}
+	if len(usable) == 0 {
+		soonest := s.endpoints[0]
+		for _, ep := range s.endpoints[1:] {
+			if ep.tEjected.Before(soonest.tEjected) {
+				soonest = ep
+			}
+		}
+		return soonest
+	}
+
+	switch s.pParam.nStrategy {
+	case BalanceFailover:
+		return usable[0]
+	case BalanceLeastConn:
+		least := usable[0]
+		for _, ep := range usable[1:] {
+			if ep.nActive < least.nActive {
+				least = ep
+			}
+		}
+		return least
+	case BalanceRandom:
+		return usable[s.rnd.Intn(len(usable))]
+	default:
+		ep := usable[s.nNext%len(usable)]
+		s.nNext++
+		return ep
+	}
+}
+
+func (s *endpointSet) dialFailed(ep *endpoint) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	ep.nActive--
+	ep.nFailures++
+	if ep.nFailures >= s.pParam.nEjectFailures {
+		ep.nFailures = 0
+		ep.tEjected = time.Now().Add(s.pParam.nEjectDuration)
+		logger.Warn("endpoint %v ejected for %v", ep.sAddr, s.pParam.nEjectDuration)
+	}
+}
+
+func (s *endpointSet) connected(ep *endpoint) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	ep.nFailures = 0
+	ep.tEjected = time.Time{}
+}
+
+func (s *endpointSet) disconnected(ep *endpoint) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	ep.nActive--
+}
@@ -0,0 +1,352 @@
+//go:build linux
+// +build linux
+
+package go_net
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/hezhis/go_log"
+)
+
+const (
+	eventReadBuffSize = 64 << 10
+	eventWaitCount    = 128
+)
+
+// eventLoop waits on an epoll instance for the sockets of its connections.
+type eventLoop struct {
+	pServer *EventServer
+
+	epfd    int
+	wakeFds [2]int
+
+	locker   sync.Mutex
+	connMap  map[int]*EventConn
+	bStopped bool
+
+	readBuff []byte
+}
+
+func newEventLoop(s *EventServer) (*eventLoop, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if nil != err {
+		return nil, err
+	}
+
+	l := &eventLoop{
+		pServer:  s,
+		epfd:     epfd,
+		connMap:  make(map[int]*EventConn),
+		readBuff: make([]byte, eventReadBuffSize),
+	}
+
+	if err := syscall.Pipe2(l.wakeFds[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); nil != err {
+		syscall.Close(epfd)
+		return nil, err
+	}
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(l.wakeFds[0])}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, l.wakeFds[0], &ev); nil != err {
+		l.closeFds()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *eventLoop) closeFds() {
+	syscall.Close(l.wakeFds[0])
+	syscall.Close(l.wakeFds[1])
+	syscall.Close(l.epfd)
+}
+
+func (l *eventLoop) run() {
+	defer l.pServer.loopWait.Done()
+	defer l.closeFds()
+
+	events := make([]syscall.EpollEvent, eventWaitCount)
+	for {
+		n, err := syscall.EpollWait(l.epfd, events, -1)
+		if nil != err {
+			if err == syscall.EINTR {
+				continue
+			}
+			logger.Error("epoll wait error! %v", err)
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			fd := int(events[i].Fd)
+			if fd == l.wakeFds[0] {
+				return
+			}
+
+			l.locker.Lock()
+			c := l.connMap[fd]
+			l.locker.Unlock()
+			if nil == c {
+				continue
+			}
+
+			if events[i].Events&syscall.EPOLLOUT != 0 {
+				l.flush(c)
+			}
+			if events[i].Events&(syscall.EPOLLIN|syscall.EPOLLRDHUP|syscall.EPOLLHUP|syscall.EPOLLERR) != 0 {
+				l.read(c)
+			}
+		}
+	}
+}
+
+func (l *eventLoop) stop() {
+	l.locker.Lock()
+	l.bStopped = true
+	l.locker.Unlock()
+
+	syscall.Write(l.wakeFds[1], []byte{0})
+}
+
+func (l *eventLoop) connList() []*EventConn {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+
+	list := make([]*EventConn, 0, len(l.connMap))
+	for _, c := range l.connMap {
+		list = append(list, c)
+	}
+	return list
+}
+
+// dupConn takes the socket of conn over, conn itself is closed.
+func dupConn(conn net.Conn) (int, error) {
+	defer conn.Close()
+
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return -1, errors.New("conn has no file descriptor")
+	}
+	raw, err := sc.SyscallConn()
+	if nil != err {
+		return -1, err
+	}
+
+	fd, dupErr := -1, error(nil)
+	syscall.ForkLock.RLock()
+	err = raw.Control(func(sfd uintptr) {
+		if fd, dupErr = syscall.Dup(int(sfd)); nil == dupErr {
+			syscall.CloseOnExec(fd)
+		}
+	})
+	syscall.ForkLock.RUnlock()
+	if nil == err {
+		err = dupErr
+	}
+	if nil != err {
+		return -1, err
+	}
+
+	if err := syscall.SetNonblock(fd, true); nil != err {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// add starts to watch the socket of c.
+func (l *eventLoop) add(c *EventConn) error {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	if c.bClosed {
+		return nil
+	}
+
+	l.locker.Lock()
+	if l.bStopped {
+		l.locker.Unlock()
+		return ErrServerClosed
+	}
+	l.connMap[c.fd] = c
+	l.locker.Unlock()
+
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLRDHUP, Fd: int32(c.fd)}
+	if len(c.outBuff) > 0 {
+		ev.Events |= syscall.EPOLLOUT
+	}
+	if err := syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_ADD, c.fd, &ev); nil != err {
+		l.locker.Lock()
+		delete(l.connMap, c.fd)
+		l.locker.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (l *eventLoop) watchWrite(c *EventConn, on bool) {
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLRDHUP, Fd: int32(c.fd)}
+	if on {
+		ev.Events |= syscall.EPOLLOUT
+	}
+	// fails while c is not added yet, add watches the pending data itself
+	syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_MOD, c.fd, &ev)
+}
+
+// read reads what the socket of c has and dispatches the complete frames.
+func (l *eventLoop) read(c *EventConn) {
+	c.locker.Lock()
+	if c.bClosed {
+		c.locker.Unlock()
+		return
+	}
+	n, err := syscall.Read(c.fd, l.readBuff)
+	if err == syscall.EAGAIN || err == syscall.EINTR {
+		c.locker.Unlock()
+		return
+	}
+	if n <= 0 || nil != err {
+		l.closeConn(c)
+		c.locker.Unlock()
+		l.pServer.connClosed(c)
+		return
+	}
+	discard := c.bClosing
+	c.locker.Unlock()
+
+	if discard {
+		return
+	}
+
+	buff := append(c.inBuff, l.readBuff[:n]...)
+	for len(buff) >= c.nHeadLength {
+		msgLen := c.msgLen(buff)
+		if msgLen > c.nMaxMsgLength {
+			logger.Error("message too long from %v", c.remoteAddr)
+			c.inBuff = nil
+			c.Destroy()
+			return
+		}
+		if uint32(len(buff)-c.nHeadLength) < msgLen {
+			break
+		}
+
+		msg := make([]byte, msgLen)
+		copy(msg, buff[c.nHeadLength:])
+		buff = buff[c.nHeadLength+int(msgLen):]
+
+		l.pServer.dispatch(c, true, func() {
+			if nil != c.agent {
+				c.agent.OnMessage(msg)
+			}
+		})
+	}
+
+	// idle connections keep no buffer
+	if len(buff) == 0 {
+		c.inBuff = nil
+	} else {
+		c.inBuff = append(c.inBuff[:0], buff...)
+	}
+}
+
+// writeBuff writes b until the socket is full and returns the rest.
+func (l *eventLoop) writeBuff(c *EventConn, b []byte) ([]byte, error) {
+	for len(b) > 0 {
+		n, err := syscall.Write(c.fd, b)
+		if n > 0 {
+			b = b[n:]
+		}
+		if nil != err {
+			if err == syscall.EINTR {
+				continue
+			}
+			if err == syscall.EAGAIN {
+				break
+			}
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+	}
+	return b, nil
+}
+
+// write writes msg or buffers it, c.locker must be held. It reports whether
+// c got closed.
+func (l *eventLoop) write(c *EventConn, msg []byte) bool {
+	if len(c.outBuff) > 0 {
+		if len(c.outBuff)+len(msg) > l.pServer.nMaxWriteBuff {
+			logger.Error("close conn: write buffer full")
+			l.resetConn(c)
+			l.closeConn(c)
+			return true
+		}
+		c.outBuff = append(c.outBuff, msg...)
+		return false
+	}
+
+	rest, err := l.writeBuff(c, msg)
+	if nil != err {
+		logger.Error("write data error! %v", err)
+		l.closeConn(c)
+		return true
+	}
+	if len(rest) > 0 {
+		c.outBuff = append(c.outBuff, rest...)
+		l.watchWrite(c, true)
+	}
+	return false
+}
+
+func (l *eventLoop) flush(c *EventConn) {
+	c.locker.Lock()
+	if c.bClosed {
+		c.locker.Unlock()
+		return
+	}
+
+	closed := false
+	rest, err := l.writeBuff(c, c.outBuff)
+	if nil != err {
+		logger.Error("write data error! %v", err)
+		l.closeConn(c)
+		closed = true
+	} else if len(rest) > 0 {
+		c.outBuff = append(c.outBuff[:0], rest...)
+	} else {
+		c.outBuff = nil
+		l.watchWrite(c, false)
+		if c.bClosing {
+			l.closeConn(c)
+			closed = true
+		}
+	}
+	c.locker.Unlock()
+
+	if closed {
+		l.pServer.connClosed(c)
+	}
+}
+
+// resetConn makes the close of c send a RST, c.locker must be held.
+func (l *eventLoop) resetConn(c *EventConn) {
+	syscall.SetsockoptLinger(c.fd, syscall.SOL_SOCKET, syscall.SO_LINGER, &syscall.Linger{Onoff: 1, Linger: 0})
+}
+
+// closeConn closes the socket of c, c.locker must be held. The fd leaves the
+// loop before it is closed so a new connection can not meet the old entry.
+func (l *eventLoop) closeConn(c *EventConn) {
+	c.bClosed = true
+	c.outBuff = nil
+
+	l.locker.Lock()
+	if l.connMap[c.fd] == c {
+		delete(l.connMap, c.fd)
+	}
+	l.locker.Unlock()
+
+	syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_DEL, c.fd, nil)
+	syscall.Close(c.fd)
+}
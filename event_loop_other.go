@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package go_net
+
+import "net"
+
+type eventLoop struct {
+	pServer *EventServer
+}
+
+func newEventLoop(_ *EventServer) (*eventLoop, error) {
+	return nil, ErrEventLoopUnsupported
+}
+
+func (l *eventLoop) run()                              {}
+func (l *eventLoop) stop()                             {}
+func (l *eventLoop) connList() []*EventConn            { return nil }
+func (l *eventLoop) add(_ *EventConn) error            { return ErrEventLoopUnsupported }
+func (l *eventLoop) resetConn(_ *EventConn)            {}
+func (l *eventLoop) closeConn(c *EventConn)            { c.bClosed = true }
+func (l *eventLoop) write(_ *EventConn, _ []byte) bool { return false }
+
+func dupConn(conn net.Conn) (int, error) {
+	conn.Close()
+	return -1, ErrEventLoopUnsupported
+}
@@ -0,0 +1,55 @@
+package go_net
+
+func EventSLocalAddr(addr string) EventServerOption {
+	return func(s *EventServer) {
+		s.sLocalHost = addr
+	}
+}
+
+func EventSHeadLen(length int) EventServerOption {
+	return func(s *EventServer) {
+		s.pCreateParam.nHeadLength = length
+	}
+}
+
+func EventSMaxClientCount(count int) EventServerOption {
+	return func(s *EventServer) {
+		s.nMaxClientCount = count
+	}
+}
+
+func EventSMaxMsgLen(length uint32) EventServerOption {
+	return func(s *EventServer) {
+		s.pCreateParam.nMaxMsgLength = length
+	}
+}
+
+func EventSLittleEndian(flag bool) EventServerOption {
+	return func(s *EventServer) {
+		s.pCreateParam.bLittleEndian = flag
+	}
+}
+
+// EventSLoops sets the number of epoll loops, the default is one per cpu.
+func EventSLoops(count int) EventServerOption {
+	return func(s *EventServer) {
+		s.nLoopCount = count
+	}
+}
+
+// EventSWorkers sets the number of workers running the agent callbacks and
+// how many callbacks each one queues before the event loops wait for it.
+func EventSWorkers(count, queueCap int) EventServerOption {
+	return func(s *EventServer) {
+		s.nWorkerCount = count
+		s.nWorkerQueueCap = queueCap
+	}
+}
+
+// EventSMaxWriteBuff limits the bytes a connection buffers while its peer
+// does not read, the connection is closed beyond it.
+func EventSMaxWriteBuff(size int) EventServerOption {
+	return func(s *EventServer) {
+		s.nMaxWriteBuff = size
+	}
+}
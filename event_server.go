@@ -0,0 +1,383 @@
+package go_net
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/hezhis/go_log"
+)
+
+var ErrEventLoopUnsupported = errors.New("event loop server requires linux")
+
+type (
+	// EventAgent receives the messages of one connection of an EventServer,
+	// the callbacks of a connection run in order on the same worker.
+	EventAgent interface {
+		OnMessage(msg []byte)
+		OnClose()
+	}
+
+	EventServerOption func(s *EventServer)
+
+	// EventServer serves connections without goroutines of their own, a few
+	// event loops wait on epoll for the sockets, cut the length prefixed
+	// frames and hand complete messages over to a worker pool.
+	EventServer struct {
+		ln     net.Listener
+		lnWait sync.WaitGroup
+
+		loops    []*eventLoop
+		loopWait sync.WaitGroup
+
+		workers    []*eventWorker
+		workerWait sync.WaitGroup
+
+		connWait  sync.WaitGroup
+		connMutex sync.Mutex
+		nConnID   uint64
+		nCount    int
+
+		pCreateParam *CreateConnectorParam
+
+		nMaxClientCount int
+		nLoopCount      int
+		nWorkerCount    int
+		nWorkerQueueCap int
+		nMaxWriteBuff   int
+		sLocalHost      string
+
+		NewAgent func(conn *EventConn) EventAgent
+	}
+
+	// eventWorker runs the queued callbacks of its connections in order.
+	eventWorker struct {
+		locker    sync.Mutex
+		cNotEmpty *sync.Cond
+		cNotFull  *sync.Cond
+		tasks     []func()
+		nCap      int
+		bStopped  bool
+	}
+
+	// EventConn is a connection of an EventServer.
+	EventConn struct {
+		frameCodec
+
+		nID   uint64
+		pLoop *eventLoop
+		agent EventAgent
+
+		localAddr  net.Addr
+		remoteAddr net.Addr
+
+		fd       int
+		locker   sync.Mutex
+		bClosed  bool
+		bClosing bool
+		inBuff   []byte
+		outBuff  []byte
+	}
+)
+
+func NewEventServer(opts ...EventServerOption) *EventServer {
+	s := &EventServer{pCreateParam: &CreateConnectorParam{}}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func (s *EventServer) init() {
+	if s.NewAgent == nil {
+		logger.Fatal("NewAgent must not be nil")
+	}
+
+	if s.pCreateParam.nHeadLength != 2 && s.pCreateParam.nHeadLength != 4 {
+		logger.Fatal("message head length must be 2 or 4")
+	}
+
+	if s.pCreateParam.nMaxMsgLength <= 0 {
+		s.pCreateParam.nMaxMsgLength = 4096
+		logger.Warn("invalid MaxMsgLen, reset to %v", s.pCreateParam.nMaxMsgLength)
+	}
+
+	if s.nMaxClientCount <= 0 {
+		s.nMaxClientCount = 100
+		logger.Info("invalid nMaxClientCount, reset to %v", s.nMaxClientCount)
+	}
+
+	if s.nLoopCount <= 0 {
+		s.nLoopCount = runtime.NumCPU()
+	}
+	if s.nWorkerCount <= 0 {
+		s.nWorkerCount = runtime.NumCPU()
+	}
+	if s.nWorkerQueueCap <= 0 {
+		s.nWorkerQueueCap = 1024
+	}
+	if s.nMaxWriteBuff <= 0 {
+		s.nMaxWriteBuff = 4 << 20
+	}
+}
+
+func (s *EventServer) Start() {
+	s.init()
+
+	for i := 0; i < s.nLoopCount; i++ {
+		loop, err := newEventLoop(s)
+		if nil != err {
+			logger.Fatal("event loop create error! %v", err)
+		}
+		s.loops = append(s.loops, loop)
+	}
+
+	ln, err := listenTcp(s.sLocalHost)
+	if nil != err {
+		logger.Fatal("event server listen error! %v", err)
+	}
+	s.ln = ln
+
+	for i := 0; i < s.nWorkerCount; i++ {
+		worker := newEventWorker(s.nWorkerQueueCap)
+		s.workers = append(s.workers, worker)
+		s.workerWait.Add(1)
+		go worker.run(&s.workerWait)
+	}
+
+	for _, loop := range s.loops {
+		s.loopWait.Add(1)
+		go loop.run()
+	}
+
+	s.lnWait.Add(1)
+	go s.acceptRun()
+}
+
+func (s *EventServer) acceptRun() {
+	defer s.lnWait.Done()
+
+	var delay time.Duration
+	for {
+		conn, err := s.ln.Accept()
+		if nil != err {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				delay = nextAcceptDelay(delay)
+				time.Sleep(delay)
+				continue
+			}
+			return
+		}
+		delay = 0
+
+		s.connMutex.Lock()
+		if s.nCount >= s.nMaxClientCount {
+			s.connMutex.Unlock()
+			logger.Error("too many connections")
+			conn.Close()
+			continue
+		}
+		s.nCount++
+		s.nConnID++
+		id := s.nConnID
+		s.connMutex.Unlock()
+
+		c := &EventConn{
+			frameCodec: newFrameCodec(s.pCreateParam),
+			nID:        id,
+			pLoop:      s.loops[id%uint64(len(s.loops))],
+			localAddr:  conn.LocalAddr(),
+			remoteAddr: conn.RemoteAddr(),
+		}
+
+		if c.fd, err = dupConn(conn); nil != err {
+			logger.Error("event server take conn error: %v", err)
+			s.connMutex.Lock()
+			s.nCount--
+			s.connMutex.Unlock()
+			continue
+		}
+
+		s.connWait.Add(1)
+		s.dispatch(c, false, func() {
+			c.agent = s.NewAgent(c)
+		})
+
+		if err := c.pLoop.add(c); nil != err {
+			logger.Error("event loop add conn error: %v", err)
+			c.Destroy()
+		}
+	}
+}
+
+// dispatch queues task on the worker of c. Messages wait for room in a full
+// queue so a slow worker slows its event loop down instead of dropping them.
+func (s *EventServer) dispatch(c *EventConn, wait bool, task func()) {
+	s.workers[c.nID%uint64(len(s.workers))].push(task, wait)
+}
+
+// connClosed queues the OnClose of c behind its pending messages.
+func (s *EventServer) connClosed(c *EventConn) {
+	s.dispatch(c, false, func() {
+		if nil != c.agent {
+			c.agent.OnClose()
+		}
+
+		s.connMutex.Lock()
+		s.nCount--
+		s.connMutex.Unlock()
+		s.connWait.Done()
+	})
+}
+
+func (s *EventServer) closeListener() {
+	if nil == s.ln {
+		return
+	}
+	unregisterListener(s.ln)
+	s.ln.Close()
+	s.lnWait.Wait()
+}
+
+// Shutdown stops accepting and waits for the existing connections to end,
+// the remaining ones are closed when ctx ends first.
+func (s *EventServer) Shutdown(ctx context.Context) error {
+	s.closeListener()
+
+	done := waitContext(ctx, &s.connWait)
+	s.Close()
+	if done {
+		return nil
+	}
+	return ctx.Err()
+}
+
+func (s *EventServer) Close() {
+	s.closeListener()
+
+	for _, loop := range s.loops {
+		for _, c := range loop.connList() {
+			c.Destroy()
+		}
+		loop.stop()
+	}
+	s.loopWait.Wait()
+
+	for _, worker := range s.workers {
+		worker.stop()
+	}
+	s.workerWait.Wait()
+}
+
+func newEventWorker(cap int) *eventWorker {
+	w := &eventWorker{nCap: cap}
+	w.cNotEmpty = sync.NewCond(&w.locker)
+	w.cNotFull = sync.NewCond(&w.locker)
+	return w
+}
+
+func (w *eventWorker) push(task func(), wait bool) {
+	w.locker.Lock()
+	defer w.locker.Unlock()
+
+	for wait && len(w.tasks) >= w.nCap && !w.bStopped {
+		w.cNotFull.Wait()
+	}
+	if w.bStopped {
+		return
+	}
+	w.tasks = append(w.tasks, task)
+	w.cNotEmpty.Signal()
+}
+
+// run runs the tasks until the worker stops and its queue is drained.
+func (w *eventWorker) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for {
+		w.locker.Lock()
+		for len(w.tasks) == 0 && !w.bStopped {
+			w.cNotEmpty.Wait()
+		}
+		if len(w.tasks) == 0 {
+			w.locker.Unlock()
+			return
+		}
+		task := w.tasks[0]
+		w.tasks[0] = nil
+		w.tasks = w.tasks[1:]
+		w.cNotFull.Signal()
+		w.locker.Unlock()
+
+		task()
+	}
+}
+
+func (w *eventWorker) stop() {
+	w.locker.Lock()
+	w.bStopped = true
+	w.cNotEmpty.Broadcast()
+	w.cNotFull.Broadcast()
+	w.locker.Unlock()
+}
+
+func (c *EventConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *EventConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// WriteMsg packs args into one frame and writes it, whatever the socket does
+// not take at once is buffered and written by the event loop.
+func (c *EventConn) WriteMsg(args ...[]byte) error {
+	msg, err := c.pack(args...)
+	if nil != err {
+		return err
+	}
+
+	c.locker.Lock()
+	if c.bClosed || c.bClosing {
+		c.locker.Unlock()
+		return nil
+	}
+	closed := c.pLoop.write(c, msg)
+	c.locker.Unlock()
+
+	if closed {
+		c.pLoop.pServer.connClosed(c)
+	}
+	return nil
+}
+
+// Close closes the connection once the buffered data is written.
+func (c *EventConn) Close() {
+	c.locker.Lock()
+	if c.bClosed || len(c.outBuff) > 0 {
+		c.bClosing = true
+		c.locker.Unlock()
+		return
+	}
+	c.pLoop.closeConn(c)
+	c.locker.Unlock()
+
+	c.pLoop.pServer.connClosed(c)
+}
+
+// Destroy closes the connection at once and drops the buffered data.
+func (c *EventConn) Destroy() {
+	c.locker.Lock()
+	if c.bClosed {
+		c.locker.Unlock()
+		return
+	}
+	c.pLoop.resetConn(c)
+	c.pLoop.closeConn(c)
+	c.locker.Unlock()
+
+	c.pLoop.pServer.connClosed(c)
+}
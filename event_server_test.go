@@ -0,0 +1,115 @@
+//go:build linux
+// +build linux
+
+package go_net
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type orderAgent struct {
+	nNext   int
+	err     error
+	cClosed chan *orderAgent
+}
+
+func (a *orderAgent) OnMessage(msg []byte) {
+	if nil == a.err && string(msg) != strconv.Itoa(a.nNext) {
+		a.err = fmt.Errorf("got %q, want %v", msg, a.nNext)
+	}
+	a.nNext++
+}
+
+func (a *orderAgent) OnClose() {
+	a.cClosed <- a
+}
+
+func startEventServer(t *testing.T, opts ...EventServerOption) (string, chan *orderAgent) {
+	addr := freeAddr(t)
+	closed := make(chan *orderAgent, 16)
+	s := NewEventServer(append([]EventServerOption{EventSLocalAddr(addr), EventSHeadLen(2)}, opts...)...)
+	s.NewAgent = func(conn *EventConn) EventAgent {
+		return &orderAgent{cClosed: closed}
+	}
+	s.Start()
+	t.Cleanup(s.Close)
+	return addr, closed
+}
+
+func frame(msg string) []byte {
+	b := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(len(msg)))
+	copy(b[2:], msg)
+	return b
+}
+
+func TestEventServerKeepsOrderPerConnection(t *testing.T) {
+	// few workers with short queues share the connections
+	addr, closed := startEventServer(t, EventSLoops(2), EventSWorkers(2, 4))
+
+	const conns, msgs = 4, 500
+	for i := 0; i < conns; i++ {
+		go func() {
+			conn, err := net.Dial("tcp", addr)
+			if nil != err {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			for j := 0; j < msgs; j++ {
+				if _, err := conn.Write(frame(strconv.Itoa(j))); nil != err {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < conns; i++ {
+		select {
+		case a := <-closed:
+			if nil != a.err {
+				t.Fatal(a.err)
+			}
+			if a.nNext != msgs {
+				t.Fatalf("OnClose after %v of %v messages", a.nNext, msgs)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the connections to close")
+		}
+	}
+}
+
+func TestEventServerRejectsOversizeMessage(t *testing.T) {
+	addr, closed := startEventServer(t, EventSMaxMsgLen(16))
+
+	conn, err := net.Dial("tcp", addr)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(frame("0")); nil != err {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(frame("a message longer than the limit")); nil != err {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); nil == err {
+		t.Fatal("connection still open after an oversize message")
+	}
+	select {
+	case a := <-closed:
+		if a.nNext != 1 {
+			t.Fatalf("got %v messages, want the one before the oversize message", a.nNext)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose not called")
+	}
+}
@@ -0,0 +1,433 @@
+package go_net
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/hezhis/go_log"
+)
+
+// the kinds of the frames on a gate link, each is followed by the session id
+const (
+	gateOpen byte = iota + 1 // the payload is the remote addr of the client
+	gateData
+	gateClose
+)
+
+const (
+	// GateHeadLength is what the gate protocol adds to every message, the
+	// max message length of the links must leave room for it.
+	GateHeadLength = 9
+	// gateRecvCap bounds the messages a session holds, a session that falls
+	// further behind is closed so it can't stall the other ones of its link.
+	gateRecvCap = 1024
+)
+
+var (
+	ErrGateNoLink = errors.New("gate has no backend link")
+	errGateFrame  = errors.New("invalid gate frame")
+)
+
+type (
+	// GateClient runs on a gate holding the client connections, it carries
+	// the sessions opened for the clients over a few links to a GateServer.
+	GateClient struct {
+		pClient *TcpClient
+
+		locker  sync.Mutex
+		links   []*gateLink
+		nNext   int
+		nLastID uint64
+	}
+
+	// GateServer runs on a backend, every session a gate opens gets an agent
+	// of its own as if the client was connected directly.
+	GateServer struct {
+		pServer *TcpServer
+
+		NewAgent func(*GateSession) Agent
+	}
+
+	// gateLink is a connection between a gate and a backend, pServer is only
+	// set on the backend side.
+	gateLink struct {
+		pConn   *TcpConnector
+		pGate   *GateClient
+		pServer *GateServer
+
+		locker     sync.Mutex
+		bClosed    bool
+		sessions   map[uint64]*GateSession
+		agentWG    sync.WaitGroup
+		sendLocker sync.Mutex
+	}
+
+	// GateSession is the virtual connection of a client of a gate.
+	GateSession struct {
+		nID        uint64
+		pLink      *gateLink
+		remoteAddr net.Addr
+
+		locker  sync.Mutex
+		bClosed bool
+		cRecv   chan []byte
+	}
+
+	// gateAddr is the client addr a gate reports when opening a session.
+	gateAddr string
+)
+
+var _ Connector = (*GateSession)(nil)
+
+// NewGateClient creates a gate client, opts configure the links, e.g.
+// TcpCConnCount for the number of links.
+func NewGateClient(opts ...TcpClientOption) *GateClient {
+	g := &GateClient{pClient: NewTcpClient(opts...)}
+	g.pClient.NewAgent = func(conn *TcpConnector) Agent {
+		return newGateLink(conn, g, nil)
+	}
+	return g
+}
+
+// Start is StartContext(context.Background()).
+func (g *GateClient) Start() {
+	g.pClient.Start()
+}
+
+func (g *GateClient) StartContext(ctx context.Context) {
+	g.pClient.StartContext(ctx)
+}
+
+func (g *GateClient) WaitConnected(ctx context.Context) error {
+	return g.pClient.WaitConnected(ctx)
+}
+
+// Close closes the links and with them every session.
+func (g *GateClient) Close() {
+	g.pClient.Close()
+}
+
+// Open opens a session for a client on one of the links, remote is reported
+// to the backend as the remote addr of the session and may be nil.
+func (g *GateClient) Open(remote net.Addr) (*GateSession, error) {
+	g.locker.Lock()
+	if len(g.links) == 0 {
+		g.locker.Unlock()
+		return nil, ErrGateNoLink
+	}
+	link := g.links[g.nNext%len(g.links)]
+	g.nNext++
+	g.nLastID++
+	id := g.nLastID
+	g.locker.Unlock()
+
+	session := link.add(id, link.pConn.RemoteAddr())
+	if nil == session {
+		return nil, ErrGateNoLink
+	}
+
+	var addr []byte
+	if nil != remote {
+		addr = []byte(remote.String())
+	}
+	if err := link.write(gateOpen, id, addr); nil != err {
+		session.closeLocal()
+		return nil, err
+	}
+	return session, nil
+}
+
+func (g *GateClient) addLink(l *gateLink) {
+	g.locker.Lock()
+	defer g.locker.Unlock()
+
+	g.links = append(g.links, l)
+}
+
+func (g *GateClient) removeLink(l *gateLink) {
+	g.locker.Lock()
+	defer g.locker.Unlock()
+
+	for i, link := range g.links {
+		if link == l {
+			g.links = append(g.links[:i], g.links[i+1:]...)
+			break
+		}
+	}
+}
+
+// NewGateServer creates a gate server, opts configure the listener of the
+// links and must match the head length and endianness of the gate.
+func NewGateServer(opts ...TcpServerOption) *GateServer {
+	s := &GateServer{pServer: NewTcpServer(opts...)}
+	s.pServer.NewAgent = func(conn *TcpConnector) Agent {
+		return newGateLink(conn, nil, s)
+	}
+	return s
+}
+
+// SetNewAgent sets NewAgent through the transport independent Connector.
+func (s *GateServer) SetNewAgent(newAgent func(Connector) Agent) {
+	s.NewAgent = func(session *GateSession) Agent {
+		return newAgent(session)
+	}
+}
+
+func (s *GateServer) Start() {
+	if s.NewAgent == nil {
+		logger.Fatal("NewAgent must not be nil")
+	}
+	s.pServer.Start()
+}
+
+// Shutdown stops accepting links and waits for them to end, the remaining
+// ones are closed along with their sessions when ctx ends first.
+func (s *GateServer) Shutdown(ctx context.Context) error {
+	return s.pServer.Shutdown(ctx)
+}
+
+func (s *GateServer) Close() {
+	s.pServer.Close()
+}
+
+// open runs the agent of a session a gate opened on l.
+func (s *GateServer) open(l *gateLink, id uint64, addr string) {
+	var remote net.Addr = gateAddr(addr)
+	if addr == "" {
+		remote = l.pConn.RemoteAddr()
+	}
+	session := l.add(id, remote)
+	if nil == session {
+		logger.Error("gate session %v opened twice", id)
+		return
+	}
+
+	l.agentWG.Add(1)
+	go func() {
+		defer l.agentWG.Done()
+
+		agent := s.NewAgent(session)
+		if nil == agent {
+			session.Close()
+			return
+		}
+		agent.LogicRun()
+		session.Close()
+		agent.OnClose()
+	}()
+}
+
+func newGateLink(conn *TcpConnector, gate *GateClient, server *GateServer) *gateLink {
+	return &gateLink{
+		pConn:    conn,
+		pGate:    gate,
+		pServer:  server,
+		sessions: make(map[uint64]*GateSession),
+	}
+}
+
+func (l *gateLink) LogicRun() {
+	if nil != l.pGate {
+		l.pGate.addLink(l)
+		defer l.pGate.removeLink(l)
+	}
+
+	for {
+		data, err := l.pConn.ReadMsg()
+		if nil != err {
+			break
+		}
+		if err := l.dispatch(data); nil != err {
+			logger.Error("gate link %v error: %v", l.pConn.RemoteAddr(), err)
+			break
+		}
+	}
+
+	l.closeSessions()
+	l.agentWG.Wait()
+}
+
+func (l *gateLink) OnClose() {}
+
+func (l *gateLink) dispatch(data []byte) error {
+	if len(data) < GateHeadLength {
+		return errGateFrame
+	}
+	id := binary.BigEndian.Uint64(data[1:])
+	payload := data[GateHeadLength:]
+
+	switch data[0] {
+	case gateOpen:
+		if nil == l.pServer {
+			return errGateFrame
+		}
+		l.pServer.open(l, id, string(payload))
+	case gateData:
+		if session := l.session(id); nil != session {
+			session.deliver(payload)
+		}
+	case gateClose:
+		if session := l.session(id); nil != session {
+			session.closeLocal()
+		}
+	default:
+		return errGateFrame
+	}
+	return nil
+}
+
+// write sends a frame of session id once the write queue of the link has
+// room, so a burst of the sessions can't overflow it.
+func (l *gateLink) write(kind byte, id uint64, args ...[]byte) error {
+	l.sendLocker.Lock()
+	defer l.sendLocker.Unlock()
+
+	if err := l.pConn.waitRoom(); nil != err {
+		return err
+	}
+	return l.send(kind, id, args...)
+}
+
+// send sends a frame without waiting, the read loop must not block on the
+// write queue.
+func (l *gateLink) send(kind byte, id uint64, args ...[]byte) error {
+	header := make([]byte, GateHeadLength)
+	header[0] = kind
+	binary.BigEndian.PutUint64(header[1:], id)
+	return l.pConn.WriteMsg(append([][]byte{header}, args...)...)
+}
+
+// add creates the session id, nil when the link is closed or id is taken.
+func (l *gateLink) add(id uint64, remote net.Addr) *GateSession {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+
+	if _, ok := l.sessions[id]; ok || l.bClosed {
+		return nil
+	}
+	session := &GateSession{
+		nID:        id,
+		pLink:      l,
+		remoteAddr: remote,
+		cRecv:      make(chan []byte, gateRecvCap),
+	}
+	l.sessions[id] = session
+	return session
+}
+
+func (l *gateLink) session(id uint64) *GateSession {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+
+	return l.sessions[id]
+}
+
+func (l *gateLink) remove(id uint64) {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+
+	delete(l.sessions, id)
+}
+
+// closeSessions ends the sessions of a lost link.
+func (l *gateLink) closeSessions() {
+	l.locker.Lock()
+	l.bClosed = true
+	sessions := l.sessions
+	l.sessions = make(map[uint64]*GateSession)
+	l.locker.Unlock()
+
+	for _, session := range sessions {
+		session.closeLocal()
+	}
+}
+
+func (s *GateSession) ID() uint64 {
+	return s.nID
+}
+
+func (s *GateSession) deliver(msg []byte) {
+	s.locker.Lock()
+	if s.bClosed {
+		s.locker.Unlock()
+		return
+	}
+	if len(s.cRecv) < cap(s.cRecv) {
+		s.cRecv <- msg
+		s.locker.Unlock()
+		return
+	}
+	s.locker.Unlock()
+
+	// called by the read loop of the link
+	logger.Error("close gate session %v: receive queue full", s.nID)
+	if s.closeLocal() {
+		s.pLink.send(gateClose, s.nID)
+	}
+}
+
+// closeLocal ends the session on this side, it reports whether the session
+// was open.
+func (s *GateSession) closeLocal() bool {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if s.bClosed {
+		return false
+	}
+	s.bClosed = true
+	close(s.cRecv)
+	s.pLink.remove(s.nID)
+	return true
+}
+
+// ReadMsg returns the next message of the session, io.EOF once the session
+// is closed and the received messages are read.
+func (s *GateSession) ReadMsg() ([]byte, error) {
+	msg, ok := <-s.cRecv
+	if !ok {
+		return nil, io.EOF
+	}
+	return msg, nil
+}
+
+func (s *GateSession) WriteMsg(args ...[]byte) error {
+	s.locker.Lock()
+	closed := s.bClosed
+	s.locker.Unlock()
+	if closed {
+		return nil
+	}
+	return s.pLink.write(gateData, s.nID, args...)
+}
+
+func (s *GateSession) LocalAddr() net.Addr {
+	return s.pLink.pConn.LocalAddr()
+}
+
+func (s *GateSession) RemoteAddr() net.Addr {
+	return s.remoteAddr
+}
+
+// Close closes the session on both sides, the link stays open.
+func (s *GateSession) Close() {
+	if s.closeLocal() {
+		s.pLink.write(gateClose, s.nID)
+	}
+}
+
+func (s *GateSession) Destroy() {
+	s.Close()
+}
+
+func (a gateAddr) Network() string {
+	return "gate"
+}
+
+func (a gateAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,150 @@
+package go_net
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+type funcAgent struct {
+	run     func()
+	cClosed chan struct{}
+}
+
+func (a *funcAgent) LogicRun() {
+	a.run()
+}
+
+func (a *funcAgent) OnClose() {
+	close(a.cClosed)
+}
+
+// startGate connects a gate to a backend whose sessions run newRun.
+func startGate(t *testing.T, newRun func(*GateSession) func()) (*GateClient, chan chan struct{}) {
+	addr := freeAddr(t)
+	closed := make(chan chan struct{}, 16)
+	server := NewGateServer(TcpSLocalAddr(addr), TcpSHeadLen(2))
+	server.NewAgent = func(session *GateSession) Agent {
+		a := &funcAgent{run: newRun(session), cClosed: make(chan struct{})}
+		closed <- a.cClosed
+		return a
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+
+	gate := NewGateClient(TcpCRemoteAddr(addr), TcpCReadHeadLen(2))
+	gate.Start()
+	t.Cleanup(gate.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := gate.WaitConnected(ctx); nil != err {
+		t.Fatal(err)
+	}
+	return gate, closed
+}
+
+// openSession opens a session once the link joined the gate.
+func openSession(t *testing.T, gate *GateClient) *GateSession {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		session, err := gate.Open(gateAddr("10.0.0.1:1234"))
+		if nil == err {
+			return session
+		}
+		if err != ErrGateNoLink || time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func waitClosed(t *testing.T, closed chan chan struct{}) {
+	t.Helper()
+	select {
+	case ch := <-closed:
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the backend agent didn't end")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the backend agent didn't start")
+	}
+}
+
+func TestGateOpenDataClose(t *testing.T) {
+	remotes := make(chan string, 1)
+	gate, closed := startGate(t, func(session *GateSession) func() {
+		return func() {
+			remotes <- session.RemoteAddr().String()
+			for {
+				msg, err := session.ReadMsg()
+				if nil != err {
+					return
+				}
+				session.WriteMsg(msg)
+			}
+		}
+	})
+
+	session := openSession(t, gate)
+	if err := session.WriteMsg([]byte("hello")); nil != err {
+		t.Fatal(err)
+	}
+	msg, err := session.ReadMsg()
+	if nil != err || string(msg) != "hello" {
+		t.Fatalf("got %q, %v", msg, err)
+	}
+	if remote := <-remotes; remote != "10.0.0.1:1234" {
+		t.Fatalf("backend sees the session from %v", remote)
+	}
+
+	session.Close()
+	waitClosed(t, closed)
+	if _, err := session.ReadMsg(); err != io.EOF {
+		t.Fatalf("got %v from a closed session", err)
+	}
+}
+
+func TestGateFullQueueClosesSession(t *testing.T) {
+	sent := make(chan struct{})
+	gate, closed := startGate(t, func(session *GateSession) func() {
+		return func() {
+			for i := 0; i < gateRecvCap+100; i++ {
+				session.WriteMsg([]byte("x"))
+			}
+			close(sent)
+			// the gate closes the session that fell behind
+			for {
+				if _, err := session.ReadMsg(); nil != err {
+					return
+				}
+			}
+		}
+	})
+
+	session := openSession(t, gate)
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the backend couldn't write")
+	}
+	waitClosed(t, closed)
+
+	n := 0
+	for {
+		if _, err := session.ReadMsg(); nil != err {
+			break
+		}
+		n++
+	}
+	if n > gateRecvCap {
+		t.Fatalf("the session held %v messages, cap is %v", n, gateRecvCap)
+	}
+
+	// the link outlives the session
+	other := openSession(t, gate)
+	other.Close()
+}
@@ -0,0 +1,197 @@
+package go_net
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/hezhis/go_log"
+)
+
+// EnvInheritFds tells a process started by Restart which listeners it
+// inherits. The value is a comma separated list of listener names, the n-th
+// name belongs to file descriptor 3+n.
+const EnvInheritFds = "GO_NET_INHERIT_FDS"
+
+type fileListener interface {
+	File() (*os.File, error)
+}
+
+var (
+	listenerLocker sync.Mutex
+	inheritOnce    sync.Once
+	inherited      map[string]net.Listener
+	activeList     map[string]net.Listener
+)
+
+func loadInherited() {
+	inherited = make(map[string]net.Listener)
+
+	names := os.Getenv(EnvInheritFds)
+	if names == "" {
+		return
+	}
+	os.Unsetenv(EnvInheritFds)
+
+	for i, name := range strings.Split(names, ",") {
+		f := os.NewFile(uintptr(3+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if nil != err {
+			logger.Error("inherit listener %v error: %v", name, err)
+			continue
+		}
+		inherited[name] = ln
+	}
+}
+
+// listenerName names the index-th listener of a server on addr.
+func listenerName(addr string, index int) string {
+	if index == 0 {
+		return addr
+	}
+	return fmt.Sprintf("%s#%d", addr, index)
+}
+
+// takeInherited returns the listener named name passed by the parent process.
+func takeInherited(name string) (net.Listener, bool) {
+	listenerLocker.Lock()
+	defer listenerLocker.Unlock()
+
+	inheritOnce.Do(loadInherited)
+	ln, ok := inherited[name]
+	if ok {
+		delete(inherited, name)
+	}
+	return ln, ok
+}
+
+// listenTcp listens on addr unless the parent process handed a listener of
+// the same name over, the listener is registered for Restart.
+func listenTcp(addr string) (net.Listener, error) {
+	name := listenerName(addr, 0)
+	ln, ok := takeInherited(name)
+	if !ok {
+		var err error
+		if ln, err = net.Listen("tcp", addr); nil != err {
+			return nil, err
+		}
+	}
+	registerListener(name, ln)
+	return ln, nil
+}
+
+// registerListener makes ln available to the child process of Restart.
+func registerListener(name string, ln net.Listener) {
+	listenerLocker.Lock()
+	defer listenerLocker.Unlock()
+
+	if nil == activeList {
+		activeList = make(map[string]net.Listener)
+	}
+	activeList[name] = ln
+}
+
+func unregisterListener(ln net.Listener) {
+	listenerLocker.Lock()
+	defer listenerLocker.Unlock()
+
+	for name, active := range activeList {
+		if active == ln {
+			delete(activeList, name)
+		}
+	}
+}
+
+// Restart starts a new instance of the running binary with the same arguments
+// and hands every server listener over to it, the new process accepts on them
+// as soon as its servers start. The caller then shuts down its own servers to
+// drain the existing sessions.
+func Restart() (*os.Process, error) {
+	path, err := os.Executable()
+	if nil != err {
+		return nil, err
+	}
+
+	listenerLocker.Lock()
+	names := make([]string, 0, len(activeList))
+	files := make([]*os.File, 0, len(activeList))
+	var unixList []*net.UnixListener
+	for name, ln := range activeList {
+		fl, ok := ln.(fileListener)
+		if !ok {
+			continue
+		}
+		f, err := fl.File()
+		if nil != err {
+			listenerLocker.Unlock()
+			closeFiles(files)
+			return nil, err
+		}
+		names = append(names, name)
+		files = append(files, f)
+		if ul, ok := ln.(*net.UnixListener); ok {
+			unixList = append(unixList, ul)
+		}
+	}
+	listenerLocker.Unlock()
+	defer closeFiles(files)
+
+	if len(files) == 0 {
+		return nil, errors.New("no listener to hand over")
+	}
+
+	env := make([]string, 0, len(os.Environ())+1)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, EnvInheritFds+"=") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env, EnvInheritFds+"="+strings.Join(names, ","))
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); nil != err {
+		return nil, err
+	}
+
+	// the child serves the socket files now, closing the listeners here must
+	// not remove them
+	for _, ul := range unixList {
+		ul.SetUnlinkOnClose(false)
+	}
+
+	logger.Info("restarted as pid %v with listeners %v", cmd.Process.Pid, names)
+	return cmd.Process, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// waitContext waits for wg and reports false if ctx ends first.
+func waitContext(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
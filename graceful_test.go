@@ -0,0 +1,77 @@
+package go_net
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// the process started by Restart in TestRestartUnixListener
+	if os.Getenv(EnvInheritFds) != "" {
+		os.Exit(serveInherited())
+	}
+	os.Exit(m.Run())
+}
+
+// serveInherited answers one connection on every inherited listener.
+func serveInherited() int {
+	inheritOnce.Do(loadInherited)
+	for _, ln := range inherited {
+		go func(ln net.Listener) {
+			for {
+				conn, err := ln.Accept()
+				if nil != err {
+					return
+				}
+				conn.Write([]byte("child"))
+				conn.Close()
+			}
+		}(ln)
+	}
+	time.Sleep(10 * time.Second)
+	return 0
+}
+
+func TestRestartUnixListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "restart.sock")
+	ln, err := net.Listen("unix", path)
+	if nil != err {
+		t.Fatal(err)
+	}
+	registerListener(path, ln)
+
+	process, err := Restart()
+	if nil != err {
+		unregisterListener(ln)
+		ln.Close()
+		t.Fatal(err)
+	}
+	defer process.Wait()
+	defer process.Kill()
+
+	// the parent shuts down after handing the listener over
+	unregisterListener(ln)
+	ln.Close()
+	if _, err := os.Stat(path); nil != err {
+		t.Fatalf("socket file removed by the parent: %v", err)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	b, err := io.ReadAll(conn)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if string(b) != "child" {
+		t.Fatalf("got %q from the restarted process", b)
+	}
+}
@@ -0,0 +1,158 @@
+package go_net
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+type (
+	ListenOption func(p *ListenParam)
+
+	// ListenParam describes one listen address of a server.
+	ListenParam struct {
+		sAddr           string
+		sCertFile       string
+		sKeyFile        string
+		pTLSConfig      *tls.Config
+		nMaxClientCount int
+	}
+
+	// serverListener is a listener of a server, raw is the socket listener
+	// registered for Restart and Listener may wrap it with tls. With bWire
+	// set the bytes written to the accepted connections are counted.
+	serverListener struct {
+		net.Listener
+		raw        net.Listener
+		pParam     *ListenParam
+		pTLSConfig *tls.Config
+		nCount     int32
+
+		bWire bool
+		wires sync.Map // accepted conn -> *wireConn
+	}
+)
+
+// ListenTLS serves tls on the listener with the certificate in certFile and
+// keyFile.
+func ListenTLS(certFile, keyFile string) ListenOption {
+	return func(p *ListenParam) {
+		p.sCertFile = certFile
+		p.sKeyFile = keyFile
+	}
+}
+
+func ListenTLSConfig(config *tls.Config) ListenOption {
+	return func(p *ListenParam) {
+		p.pTLSConfig = config
+	}
+}
+
+// ListenMaxClientCount limits the connections accepted on the listener, the
+// limit of the server applies as well.
+func ListenMaxClientCount(count int) ListenOption {
+	return func(p *ListenParam) {
+		p.nMaxClientCount = count
+	}
+}
+
+func newListenParam(addr string, opts ...ListenOption) *ListenParam {
+	p := &ListenParam{sAddr: addr}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+func (p *ListenParam) tlsConfig(nextProtos ...string) (*tls.Config, error) {
+	if nil != p.pTLSConfig {
+		return p.pTLSConfig, nil
+	}
+	if p.sCertFile == "" && p.sKeyFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(p.sCertFile, p.sKeyFile)
+	if nil != err {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   nextProtos,
+	}, nil
+}
+
+// newServerListener serves tls on ln when config is set.
+func newServerListener(ln net.Listener, param *ListenParam, config *tls.Config) *serverListener {
+	l := &serverListener{Listener: ln, raw: ln, pParam: param, pTLSConfig: config}
+	if nil != config {
+		l.Listener = tls.NewListener(ln, config)
+	}
+	return l
+}
+
+func (l *serverListener) Accept() (net.Conn, error) {
+	if !l.bWire {
+		return l.Listener.Accept()
+	}
+
+	raw, err := l.raw.Accept()
+	if nil != err {
+		return nil, err
+	}
+	wire := &wireConn{Conn: raw}
+	var conn net.Conn = wire
+	if nil != l.pTLSConfig {
+		conn = tls.Server(wire, l.pTLSConfig)
+	}
+	wire.onClose = func() {
+		l.wires.Delete(conn)
+	}
+	l.wires.Store(conn, wire)
+	return conn, nil
+}
+
+// wireOf returns the counter of conn accepted on l, nil without bWire.
+func (l *serverListener) wireOf(conn net.Conn) *wireConn {
+	if wire, ok := l.wires.Load(conn); ok {
+		return wire.(*wireConn)
+	}
+	return nil
+}
+
+// acquire counts a connection unless the listener reached its own client
+// limit, the connection is given back by release.
+func (l *serverListener) acquire() bool {
+	for {
+		n := atomic.LoadInt32(&l.nCount)
+		if l.pParam.nMaxClientCount > 0 && int(n) >= l.pParam.nMaxClientCount {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&l.nCount, n, n+1) {
+			return true
+		}
+	}
+}
+
+func (l *serverListener) release() {
+	atomic.AddInt32(&l.nCount, -1)
+}
+
+func (l *serverListener) close() {
+	unregisterListener(l.raw)
+	l.Listener.Close()
+}
+
+func closeRawListeners(raws []net.Listener) {
+	for _, raw := range raws {
+		unregisterListener(raw)
+		raw.Close()
+	}
+}
+
+func closeServerListeners(lnList []*serverListener) {
+	for _, l := range lnList {
+		l.close()
+	}
+}
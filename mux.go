@@ -0,0 +1,501 @@
+package go_net
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/hezhis/go_log"
+)
+
+// the kinds of the mux frames, each is followed by the stream id
+const (
+	muxOpen byte = iota + 1
+	muxData
+	muxWindow // the payload is the window increment
+	muxClose
+	muxReset
+
+	// muxOpener is set in the kind of the frames of streams the sender
+	// opened, so both sides count their stream ids on their own.
+	muxOpener byte = 0x80
+)
+
+const (
+	// MuxHeadLength is what the mux protocol adds to every message, the max
+	// message length of the connection must leave room for it.
+	MuxHeadLength = 5
+	// muxInitialWindow is the receive window every stream starts with, a
+	// larger MuxWindow is granted with a window frame after the open.
+	muxInitialWindow = 256 << 10
+)
+
+var (
+	ErrMuxClosed   = errors.New("mux closed")
+	ErrStreamReset = errors.New("stream reset")
+	errMuxFrame    = errors.New("invalid mux frame")
+)
+
+type (
+	MuxOption func(m *Mux)
+
+	// Mux carries independent streams over one connection, both sides open
+	// and accept streams. A Mux is the agent of its connection, the streams
+	// are served by the agents of MuxNewAgent or taken by Accept.
+	Mux struct {
+		pConn    Connector
+		nWindow  uint32
+		nBacklog int
+		newAgent func(Connector) Agent
+
+		locker  sync.Mutex
+		streams map[uint64]*MuxStream
+		nLastID uint32
+		bClosed bool
+		cAccept chan *MuxStream
+
+		sendLocker sync.Mutex
+		dataLocker sync.Mutex
+		agentWG    sync.WaitGroup
+	}
+
+	// MuxStream is a stream of a Mux. The peer may send as many bytes as the
+	// window grants, WriteMsg waits for the window to open and may overdraw
+	// it by one message.
+	MuxStream struct {
+		pMux    *Mux
+		nID     uint32
+		bRemote bool // opened by the peer
+
+		locker        sync.Mutex
+		cond          *sync.Cond
+		recv          [][]byte
+		nRecvBytes    int64
+		nConsumed     uint32
+		nSendWindow   int64
+		bLocalClosed  bool
+		bRemoteClosed bool
+		err           error
+	}
+)
+
+var _ Connector = (*MuxStream)(nil)
+
+// MuxWindow sets the receive window of the streams, at least the initial
+// window of 256KB.
+func MuxWindow(size uint32) MuxOption {
+	return func(m *Mux) {
+		m.nWindow = size
+	}
+}
+
+// MuxNewAgent serves every accepted stream with an agent of newAgent.
+func MuxNewAgent(newAgent func(Connector) Agent) MuxOption {
+	return func(m *Mux) {
+		m.newAgent = newAgent
+	}
+}
+
+// MuxAcceptBacklog bounds the streams waiting for Accept, further ones are
+// reset.
+func MuxAcceptBacklog(count int) MuxOption {
+	return func(m *Mux) {
+		m.nBacklog = count
+	}
+}
+
+// NewMux creates the mux of conn, it's returned as the agent of conn.
+func NewMux(conn Connector, opts ...MuxOption) *Mux {
+	m := &Mux{pConn: conn, streams: make(map[uint64]*MuxStream)}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.nWindow < muxInitialWindow {
+		m.nWindow = muxInitialWindow
+	}
+	if m.nBacklog <= 0 {
+		m.nBacklog = 256
+	}
+	m.cAccept = make(chan *MuxStream, m.nBacklog)
+	return m
+}
+
+func muxKey(id uint32, remote bool) uint64 {
+	key := uint64(id) << 1
+	if remote {
+		key |= 1
+	}
+	return key
+}
+
+// LogicRun reads the frames of the connection until it ends, the streams
+// fail with ErrMuxClosed afterwards.
+func (m *Mux) LogicRun() {
+	for {
+		data, err := m.pConn.ReadMsg()
+		if nil != err {
+			break
+		}
+		if err := m.dispatch(data); nil != err {
+			logger.Error("mux %v error: %v", m.pConn.RemoteAddr(), err)
+			break
+		}
+	}
+
+	m.locker.Lock()
+	m.bClosed = true
+	streams := m.streams
+	m.streams = make(map[uint64]*MuxStream)
+	m.locker.Unlock()
+
+	for _, s := range streams {
+		s.fail(ErrMuxClosed)
+	}
+	close(m.cAccept)
+	m.agentWG.Wait()
+}
+
+func (m *Mux) OnClose() {}
+
+// Open opens a stream to the peer.
+func (m *Mux) Open() (*MuxStream, error) {
+	m.locker.Lock()
+	if m.bClosed {
+		m.locker.Unlock()
+		return nil, ErrMuxClosed
+	}
+	m.nLastID++
+	s := newMuxStream(m, m.nLastID, false)
+	m.streams[muxKey(s.nID, false)] = s
+	m.locker.Unlock()
+
+	if err := m.write(muxOpen, s); nil != err {
+		m.remove(s)
+		return nil, err
+	}
+	m.grantWindow(s)
+	return s, nil
+}
+
+// Accept returns the next stream the peer opened, streams are only queued
+// for Accept without MuxNewAgent.
+func (m *Mux) Accept() (*MuxStream, error) {
+	s, ok := <-m.cAccept
+	if !ok {
+		return nil, ErrMuxClosed
+	}
+	return s, nil
+}
+
+// Close closes the connection and with it every stream.
+func (m *Mux) Close() {
+	m.pConn.Close()
+}
+
+func (m *Mux) dispatch(data []byte) error {
+	if len(data) < MuxHeadLength {
+		return errMuxFrame
+	}
+	kind := data[0] &^ muxOpener
+	remote := data[0]&muxOpener != 0
+	id := binary.BigEndian.Uint32(data[1:])
+	payload := data[MuxHeadLength:]
+
+	if kind == muxOpen {
+		if !remote {
+			return errMuxFrame
+		}
+		m.accept(id)
+		return nil
+	}
+
+	m.locker.Lock()
+	s := m.streams[muxKey(id, remote)]
+	m.locker.Unlock()
+	if nil == s {
+		// frames sent before the peer saw a reset or close
+		return nil
+	}
+
+	switch kind {
+	case muxData:
+		s.received(payload)
+	case muxWindow:
+		if len(payload) != 4 {
+			return errMuxFrame
+		}
+		s.opened(int64(binary.BigEndian.Uint32(payload)))
+	case muxClose:
+		s.remoteClosed()
+	case muxReset:
+		s.fail(ErrStreamReset)
+		m.remove(s)
+	default:
+		return errMuxFrame
+	}
+	return nil
+}
+
+// accept takes a stream the peer opened.
+func (m *Mux) accept(id uint32) {
+	m.locker.Lock()
+	key := muxKey(id, true)
+	if _, ok := m.streams[key]; ok || m.bClosed {
+		m.locker.Unlock()
+		return
+	}
+	s := newMuxStream(m, id, true)
+	m.streams[key] = s
+	m.locker.Unlock()
+
+	m.grantWindow(s)
+
+	if nil != m.newAgent {
+		m.agentWG.Add(1)
+		go func() {
+			defer m.agentWG.Done()
+
+			agent := m.newAgent(s)
+			if nil == agent {
+				s.Destroy()
+				return
+			}
+			agent.LogicRun()
+			s.Close()
+			agent.OnClose()
+		}()
+		return
+	}
+
+	select {
+	case m.cAccept <- s:
+	default:
+		logger.Error("mux accept backlog full, reset stream %v", id)
+		s.Destroy()
+	}
+}
+
+// grantWindow grants the part of the window above the initial one.
+func (m *Mux) grantWindow(s *MuxStream) {
+	if m.nWindow > muxInitialWindow {
+		m.writeWindow(s, m.nWindow-muxInitialWindow)
+	}
+}
+
+func (m *Mux) writeWindow(s *MuxStream, delta uint32) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, delta)
+	m.write(muxWindow, s, b)
+}
+
+// write sends a frame of s, data frames wait for room in the write queue of
+// the connection. Other frames never wait as the read loop sends them, the
+// waiting data frames hold dataLocker only.
+func (m *Mux) write(kind byte, s *MuxStream, args ...[]byte) error {
+	header := make([]byte, MuxHeadLength)
+	header[0] = kind
+	if !s.bRemote {
+		header[0] |= muxOpener
+	}
+	binary.BigEndian.PutUint32(header[1:], s.nID)
+
+	if waiter, ok := m.pConn.(roomWaiter); ok && kind == muxData {
+		m.dataLocker.Lock()
+		defer m.dataLocker.Unlock()
+
+		if err := waiter.waitRoom(); nil != err {
+			return err
+		}
+	}
+
+	m.sendLocker.Lock()
+	defer m.sendLocker.Unlock()
+
+	return m.pConn.WriteMsg(append([][]byte{header}, args...)...)
+}
+
+func (m *Mux) remove(s *MuxStream) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	key := muxKey(s.nID, s.bRemote)
+	if m.streams[key] == s {
+		delete(m.streams, key)
+	}
+}
+
+func newMuxStream(m *Mux, id uint32, remote bool) *MuxStream {
+	s := &MuxStream{
+		pMux:        m,
+		nID:         id,
+		bRemote:     remote,
+		nSendWindow: muxInitialWindow,
+	}
+	s.cond = sync.NewCond(&s.locker)
+	return s
+}
+
+func (s *MuxStream) ID() uint32 {
+	return s.nID
+}
+
+// received queues msg, a peer sending far beyond the window gets the stream
+// reset.
+func (s *MuxStream) received(msg []byte) {
+	s.locker.Lock()
+	if s.bRemoteClosed || nil != s.err {
+		s.locker.Unlock()
+		return
+	}
+	s.nRecvBytes += int64(len(msg))
+	overrun := s.nRecvBytes+int64(s.nConsumed) > 2*int64(s.pMux.nWindow)
+	if !overrun {
+		s.recv = append(s.recv, msg)
+	}
+	s.cond.Broadcast()
+	s.locker.Unlock()
+
+	if overrun {
+		logger.Error("mux stream %v overran its window", s.nID)
+		s.Destroy()
+	}
+}
+
+func (s *MuxStream) opened(delta int64) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	s.nSendWindow += delta
+	s.cond.Broadcast()
+}
+
+func (s *MuxStream) remoteClosed() {
+	s.locker.Lock()
+	s.bRemoteClosed = true
+	done := s.bLocalClosed
+	s.cond.Broadcast()
+	s.locker.Unlock()
+
+	if done {
+		s.pMux.remove(s)
+	}
+}
+
+// fail ends both directions of the stream with err.
+func (s *MuxStream) fail(err error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if nil == s.err {
+		s.err = err
+	}
+	s.cond.Broadcast()
+}
+
+// ReadMsg returns the next message, io.EOF once the peer closed the stream
+// and the received messages are read.
+func (s *MuxStream) ReadMsg() ([]byte, error) {
+	s.locker.Lock()
+	for len(s.recv) == 0 && !s.bRemoteClosed && nil == s.err {
+		s.cond.Wait()
+	}
+	if nil != s.err {
+		err := s.err
+		s.locker.Unlock()
+		return nil, err
+	}
+	if len(s.recv) == 0 {
+		s.locker.Unlock()
+		return nil, io.EOF
+	}
+
+	msg := s.recv[0]
+	s.recv[0] = nil
+	s.recv = s.recv[1:]
+	s.nRecvBytes -= int64(len(msg))
+	s.nConsumed += uint32(len(msg))
+
+	// the window is granted back in halves to keep the frames few
+	var delta uint32
+	if s.nConsumed >= s.pMux.nWindow/2 && !s.bRemoteClosed {
+		delta = s.nConsumed
+		s.nConsumed = 0
+	}
+	s.locker.Unlock()
+
+	if delta > 0 {
+		s.pMux.writeWindow(s, delta)
+	}
+	return msg, nil
+}
+
+// WriteMsg sends args as one message once the window of the peer is open.
+func (s *MuxStream) WriteMsg(args ...[]byte) error {
+	var msgLen int64
+	for _, arg := range args {
+		msgLen += int64(len(arg))
+	}
+
+	s.locker.Lock()
+	for s.nSendWindow <= 0 && !s.bLocalClosed && nil == s.err {
+		s.cond.Wait()
+	}
+	if nil != s.err {
+		err := s.err
+		s.locker.Unlock()
+		return err
+	}
+	if s.bLocalClosed {
+		s.locker.Unlock()
+		return ErrStreamClosed
+	}
+	s.nSendWindow -= msgLen
+	s.locker.Unlock()
+
+	if err := s.pMux.write(muxData, s, args...); nil != err {
+		// the message never reached the peer, give its window back
+		s.opened(msgLen)
+		return err
+	}
+	return nil
+}
+
+func (s *MuxStream) LocalAddr() net.Addr {
+	return s.pMux.pConn.LocalAddr()
+}
+
+func (s *MuxStream) RemoteAddr() net.Addr {
+	return s.pMux.pConn.RemoteAddr()
+}
+
+// Close ends the writing side, the stream is gone once the peer closed its
+// side as well.
+func (s *MuxStream) Close() {
+	s.locker.Lock()
+	if s.bLocalClosed || nil != s.err {
+		s.locker.Unlock()
+		return
+	}
+	s.bLocalClosed = true
+	done := s.bRemoteClosed
+	s.cond.Broadcast()
+	s.locker.Unlock()
+
+	s.pMux.write(muxClose, s)
+	if done {
+		s.pMux.remove(s)
+	}
+}
+
+// Destroy resets the stream, both sides drop it at once.
+func (s *MuxStream) Destroy() {
+	s.fail(ErrStreamReset)
+	s.reset()
+}
+
+func (s *MuxStream) reset() {
+	s.pMux.write(muxReset, s)
+	s.pMux.remove(s)
+}
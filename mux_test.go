@@ -0,0 +1,232 @@
+package go_net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memConn is one end of an in-memory connection.
+type memConn struct {
+	cRecv   chan []byte
+	cClosed chan struct{}
+	once    *sync.Once
+	peer    *memConn
+	nMax    int
+}
+
+func memPipe() (*memConn, *memConn) {
+	closed, once := make(chan struct{}), &sync.Once{}
+	a := &memConn{cRecv: make(chan []byte, 4096), cClosed: closed, once: once, nMax: 1 << 20}
+	b := &memConn{cRecv: make(chan []byte, 4096), cClosed: closed, once: once, nMax: 1 << 20}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func (c *memConn) ReadMsg() ([]byte, error) {
+	select {
+	case msg := <-c.cRecv:
+		return msg, nil
+	case <-c.cClosed:
+		return nil, io.EOF
+	}
+}
+
+func (c *memConn) WriteMsg(args ...[]byte) error {
+	msg := bytes.Join(args, nil)
+	if len(msg) > c.nMax {
+		return errors.New("message too long")
+	}
+	select {
+	case c.peer.cRecv <- msg:
+	case <-c.cClosed:
+	}
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return gateAddr("local") }
+func (c *memConn) RemoteAddr() net.Addr { return gateAddr("remote") }
+
+func (c *memConn) Close() {
+	c.once.Do(func() {
+		close(c.cClosed)
+	})
+}
+
+func (c *memConn) Destroy() {
+	c.Close()
+}
+
+func runMux(t *testing.T, m *Mux) {
+	done := make(chan struct{})
+	go func() {
+		m.LogicRun()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		m.Close()
+		<-done
+	})
+}
+
+func muxPair(t *testing.T, opts ...MuxOption) (*Mux, *Mux) {
+	a, b := memPipe()
+	ma, mb := NewMux(a), NewMux(b, opts...)
+	runMux(t, ma)
+	runMux(t, mb)
+	return ma, mb
+}
+
+func muxStreams(m *Mux) int {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	return len(m.streams)
+}
+
+func TestMuxWindow(t *testing.T) {
+	ma, mb := muxPair(t)
+	s, err := ma.Open()
+	if nil != err {
+		t.Fatal(err)
+	}
+	peer, err := mb.Accept()
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	chunk := make([]byte, 64<<10)
+	for i := 0; i < muxInitialWindow/len(chunk); i++ {
+		if err := s.WriteMsg(chunk); nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	// the window is used up until the peer reads half of it
+	written := make(chan error, 1)
+	go func() {
+		written <- s.WriteMsg(chunk)
+	}()
+	select {
+	case err := <-written:
+		t.Fatalf("wrote beyond the window: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := peer.ReadMsg(); nil != err {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case err := <-written:
+		if nil != err {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the granted window didn't reach the writer")
+	}
+
+	// a message the connection refuses gives its window back
+	s.locker.Lock()
+	window := s.nSendWindow
+	s.locker.Unlock()
+	if err := s.WriteMsg(make([]byte, 2<<20)); nil == err {
+		t.Fatal("wrote a message longer than the connection allows")
+	}
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if s.nSendWindow != window {
+		t.Fatalf("window %v after a failed write, was %v", s.nSendWindow, window)
+	}
+}
+
+func TestMuxOverrunResetsStream(t *testing.T) {
+	raw, conn := memPipe()
+	m := NewMux(conn)
+	runMux(t, m)
+
+	frame := func(kind byte, payload []byte) []byte {
+		header := make([]byte, MuxHeadLength)
+		header[0] = kind | muxOpener
+		binary.BigEndian.PutUint32(header[1:], 1)
+		return append(header, payload...)
+	}
+
+	// a peer that ignores the window
+	raw.WriteMsg(frame(muxOpen, nil))
+	chunk := make([]byte, 64<<10)
+	for sent := 0; sent <= 2*muxInitialWindow; sent += len(chunk) {
+		raw.WriteMsg(frame(muxData, chunk))
+	}
+
+	s, err := m.Accept()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, err := s.ReadMsg(); err != ErrStreamReset {
+		t.Fatalf("got %v from an overrun stream", err)
+	}
+	msg, err := raw.ReadMsg()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if msg[0] != muxReset || binary.BigEndian.Uint32(msg[1:]) != 1 {
+		t.Fatalf("got frame %v, want the reset of stream 1", msg[:MuxHeadLength])
+	}
+}
+
+func TestMuxOpenCloseRace(t *testing.T) {
+	echo := func(conn Connector) Agent {
+		return &funcAgent{cClosed: make(chan struct{}), run: func() {
+			for {
+				msg, err := conn.ReadMsg()
+				if nil != err {
+					return
+				}
+				conn.WriteMsg(msg)
+			}
+		}}
+	}
+	ma, mb := muxPair(t, MuxNewAgent(echo))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			s, err := ma.Open()
+			if nil != err {
+				t.Error(err)
+				return
+			}
+			if err := s.WriteMsg([]byte("x")); nil != err {
+				t.Error(err)
+				return
+			}
+			s.Close()
+			if msg, err := s.ReadMsg(); nil != err || string(msg) != "x" {
+				t.Errorf("got %q, %v", msg, err)
+				return
+			}
+			if _, err := s.ReadMsg(); err != io.EOF {
+				t.Errorf("got %v after the echo", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// both sides closed every stream
+	deadline := time.Now().Add(5 * time.Second)
+	for muxStreams(ma) > 0 || muxStreams(mb) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v and %v streams left", muxStreams(ma), muxStreams(mb))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
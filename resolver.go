@@ -0,0 +1,267 @@
+package go_net
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hezhis/go_log"
+)
+
+var ErrNoEndpoint = errors.New("no endpoint available")
+
+// lookupInterval is the min time between two lookups of a DNSResolver or a
+// SRVResolver when MinInterval is not set.
+const lookupInterval = 5 * time.Second
+
+type (
+	// Resolver returns the current endpoint list of a client. It's consulted
+	// before every dial, so implementations should be cheap or cache. A
+	// client closes its resolver on Close when it implements io.Closer.
+	Resolver interface {
+		Resolve(ctx context.Context) ([]string, error)
+	}
+
+	StaticResolver []string
+
+	// DNSResolver resolves the A/AAAA records of Host and pairs them with Port.
+	DNSResolver struct {
+		Host        string
+		Port        string
+		Network     string        // "ip", "ip4" or "ip6", default "ip"
+		MinInterval time.Duration // the result is reused for it, default 5 seconds
+		NetResolver *net.Resolver
+
+		cache lookupCache
+	}
+
+	// SRVResolver looks up _Service._Proto.Name and returns target:port in priority order.
+	SRVResolver struct {
+		Service     string
+		Proto       string
+		Name        string
+		MinInterval time.Duration // the result is reused for it, default 5 seconds
+		NetResolver *net.Resolver
+
+		cache lookupCache
+	}
+
+	// lookupCache keeps the result of the last successful lookup.
+	lookupCache struct {
+		locker  sync.Mutex
+		tLookup time.Time
+		asAddrs []string
+	}
+
+	// FileResolver reads endpoints from a JSON file, either an array of
+	// addresses or an object with an "endpoints" array. The file is watched
+	// from its own goroutine and parsed again whenever it changes, Resolve
+	// returns the cached list.
+	FileResolver struct {
+		sPath     string
+		nInterval time.Duration
+
+		startOnce sync.Once
+		stopOnce  sync.Once
+		cStop     chan struct{}
+
+		locker   sync.Mutex
+		tModTime time.Time
+		nSize    int64
+		asAddrs  []string
+		pErr     error
+	}
+)
+
+func (r StaticResolver) Resolve(_ context.Context) ([]string, error) {
+	return r, nil
+}
+
+func (r *DNSResolver) Resolve(ctx context.Context) ([]string, error) {
+	return r.cache.get(r.MinInterval, func() ([]string, error) {
+		return r.lookup(ctx)
+	})
+}
+
+func (r *DNSResolver) lookup(ctx context.Context) ([]string, error) {
+	resolver := r.NetResolver
+	if nil == resolver {
+		resolver = net.DefaultResolver
+	}
+	network := r.Network
+	if network == "" {
+		network = "ip"
+	}
+
+	ips, err := resolver.LookupIP(ctx, network, r.Host)
+	if nil != err {
+		return nil, err
+	}
+
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), r.Port))
+	}
+	return addrs, nil
+}
+
+func (r *SRVResolver) Resolve(ctx context.Context) ([]string, error) {
+	return r.cache.get(r.MinInterval, func() ([]string, error) {
+		return r.lookup(ctx)
+	})
+}
+
+func (r *SRVResolver) lookup(ctx context.Context) ([]string, error) {
+	resolver := r.NetResolver
+	if nil == resolver {
+		resolver = net.DefaultResolver
+	}
+
+	_, records, err := resolver.LookupSRV(ctx, r.Service, r.Proto, r.Name)
+	if nil != err {
+		return nil, err
+	}
+
+	addrs := make([]string, 0, len(records))
+	for _, record := range records {
+		host := strings.TrimSuffix(record.Target, ".")
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+	}
+	return addrs, nil
+}
+
+// get returns the cached list while it's younger than interval, otherwise
+// the result of lookup. Failed lookups are not cached.
+func (c *lookupCache) get(interval time.Duration, lookup func() ([]string, error)) ([]string, error) {
+	if interval <= 0 {
+		interval = lookupInterval
+	}
+
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	if nil != c.asAddrs && time.Since(c.tLookup) < interval {
+		return c.asAddrs, nil
+	}
+	addrs, err := lookup()
+	if nil != err {
+		return nil, err
+	}
+	c.tLookup = time.Now()
+	c.asAddrs = addrs
+	return addrs, nil
+}
+
+// closeResolver stops a resolver running in the background.
+func closeResolver(r Resolver) {
+	if closer, ok := r.(io.Closer); ok {
+		if err := closer.Close(); nil != err {
+			logger.Error("close resolver error: %v", err)
+		}
+	}
+}
+
+// NewFileResolver watches the file at path, checking it for changes every
+// interval, 5 seconds when interval <= 0.
+func NewFileResolver(path string, interval time.Duration) *FileResolver {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	return &FileResolver{
+		sPath:     path,
+		nInterval: interval,
+		cStop:     make(chan struct{}),
+	}
+}
+
+func (r *FileResolver) Resolve(_ context.Context) ([]string, error) {
+	r.startOnce.Do(func() {
+		r.pErr = r.refresh()
+		go r.watch()
+	})
+
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	if nil == r.asAddrs {
+		return nil, r.pErr
+	}
+	return r.asAddrs, nil
+}
+
+// Close stops watching the file, the client using r calls it on its Close.
+func (r *FileResolver) Close() error {
+	r.stopOnce.Do(func() {
+		close(r.cStop)
+	})
+	return nil
+}
+
+func (r *FileResolver) watch() {
+	ticker := time.NewTicker(r.nInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := r.refresh()
+			if nil != err {
+				logger.Error("refresh endpoint file %v error: %v", r.sPath, err)
+			}
+			r.locker.Lock()
+			r.pErr = err
+			r.locker.Unlock()
+		case <-r.cStop:
+			return
+		}
+	}
+}
+
+// refresh parses the file again if it changed, the last good list is kept
+// when the file can't be read or parsed.
+func (r *FileResolver) refresh() error {
+	info, err := os.Stat(r.sPath)
+	if nil != err {
+		return err
+	}
+
+	r.locker.Lock()
+	unchanged := nil != r.asAddrs && info.ModTime().Equal(r.tModTime) && info.Size() == r.nSize
+	r.locker.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(r.sPath)
+	if nil != err {
+		return err
+	}
+
+	var addrs []string
+	if err := json.Unmarshal(data, &addrs); nil != err {
+		var registry struct {
+			Endpoints []string `json:"endpoints"`
+		}
+		if err := json.Unmarshal(data, &registry); nil != err {
+			return err
+		}
+		addrs = registry.Endpoints
+	}
+	if nil == addrs {
+		addrs = []string{}
+	}
+
+	r.locker.Lock()
+	r.tModTime = info.ModTime()
+	r.nSize = info.Size()
+	r.asAddrs = addrs
+	r.locker.Unlock()
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build darwin || freebsd
+// +build darwin freebsd
+
+package go_net
+
+import "syscall"
+
+const soReusePort = syscall.SO_REUSEPORT
@@ -0,0 +1,7 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le && !sparc64
+// +build linux,!mips,!mipsle,!mips64,!mips64le,!sparc64
+
+package go_net
+
+// the syscall package of linux doesn't define SO_REUSEPORT
+const soReusePort = 0xf
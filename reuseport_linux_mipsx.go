@@ -0,0 +1,8 @@
+//go:build linux && (mips || mipsle || mips64 || mips64le || sparc64)
+// +build linux
+// +build mips mipsle mips64 mips64le sparc64
+
+package go_net
+
+// the syscall package of linux doesn't define SO_REUSEPORT
+const soReusePort = 0x200
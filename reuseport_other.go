@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package go_net
+
+import (
+	"errors"
+	"syscall"
+)
+
+func reusePortControl(_, _ string, _ syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not supported on this platform")
+}
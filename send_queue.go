@@ -0,0 +1,236 @@
+package go_net
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hezhis/go_log"
+)
+
+type OverflowPolicy int
+
+const (
+	OverflowDropOldest OverflowPolicy = iota + 1
+	OverflowDropNewest
+	OverflowReject // Send returns ErrSendQueueFull
+)
+
+var ErrSendQueueFull = errors.New("send queue full")
+
+type (
+	SendQueueParam struct {
+		nMaxCount int
+		nMaxBytes int
+		nTTL      time.Duration
+		nPolicy   OverflowPolicy
+	}
+
+	pendingMsg struct {
+		data    []byte
+		tExpire time.Time
+	}
+
+	// sendQueue holds messages sent through a client while it has no
+	// connection and flushes them in order to the next one. Delivery is at
+	// most once, a message handed to a connection is lost when the connection
+	// drops before writing it unless the session protocol replays it.
+	sendQueue struct {
+		pParam *SendQueueParam
+
+		locker  sync.Mutex
+		pending []pendingMsg
+		nBytes  int
+		targets []*sendTarget
+		nNext   int
+
+		// a full queue being flushed makes senders wait instead of overflow
+		nFlushing int
+		cFlushed  *sync.Cond
+	}
+
+	// sendTarget is a connection of the client, locker orders the writers
+	// waiting for room in its write queue.
+	sendTarget struct {
+		pConn  Connector
+		locker sync.Mutex
+	}
+)
+
+func newSendQueue(param *SendQueueParam) *sendQueue {
+	if param.nMaxCount <= 0 {
+		param.nMaxCount = 1024
+	}
+	if param.nPolicy < OverflowDropOldest || param.nPolicy > OverflowReject {
+		param.nPolicy = OverflowDropOldest
+	}
+	q := &sendQueue{pParam: param}
+	q.cFlushed = sync.NewCond(&q.locker)
+	return q
+}
+
+func (q *sendQueue) send(args ...[]byte) error {
+	var size int
+	for _, arg := range args {
+		size += len(arg)
+	}
+
+	q.locker.Lock()
+	for {
+		if len(q.targets) > 0 && len(q.pending) == 0 {
+			target := q.targets[q.nNext%len(q.targets)]
+			q.nNext++
+			q.locker.Unlock()
+
+			if ok, err := target.write(args...); ok {
+				return err
+			}
+
+			// the connection died before its agent ended, queue the message
+			// for the next one
+			q.locker.Lock()
+			q.remove(target.pConn)
+			continue
+		}
+		if q.nFlushing > 0 && q.full(size) {
+			q.cFlushed.Wait()
+			continue
+		}
+		break
+	}
+	defer q.locker.Unlock()
+
+	if q.pParam.nMaxBytes > 0 && size > q.pParam.nMaxBytes {
+		return ErrSendQueueFull
+	}
+
+	q.dropExpired(time.Now())
+	for q.full(size) {
+		switch q.pParam.nPolicy {
+		case OverflowDropOldest:
+			logger.Warn("send queue full, drop the oldest message")
+			q.nBytes -= len(q.pending[0].data)
+			q.pending[0] = pendingMsg{}
+			q.pending = q.pending[1:]
+		case OverflowDropNewest:
+			logger.Warn("send queue full, drop the message")
+			return nil
+		default:
+			return ErrSendQueueFull
+		}
+	}
+
+	data := make([]byte, 0, size)
+	for _, arg := range args {
+		data = append(data, arg...)
+	}
+	msg := pendingMsg{data: data}
+	if q.pParam.nTTL > 0 {
+		msg.tExpire = time.Now().Add(q.pParam.nTTL)
+	}
+	q.pending = append(q.pending, msg)
+	q.nBytes += size
+	return nil
+}
+
+// full reports whether a message of size doesn't fit, it must be called with
+// locker held.
+func (q *sendQueue) full(size int) bool {
+	return len(q.pending) >= q.pParam.nMaxCount || (q.pParam.nMaxBytes > 0 && q.nBytes+size > q.pParam.nMaxBytes)
+}
+
+func (q *sendQueue) dropExpired(now time.Time) {
+	n := 0
+	for n < len(q.pending) && !q.pending[n].tExpire.IsZero() && now.After(q.pending[n].tExpire) {
+		q.nBytes -= len(q.pending[n].data)
+		n++
+	}
+	if n > 0 {
+		logger.Warn("send queue drop %v expired messages", n)
+		q.pending = append(q.pending[:0], q.pending[n:]...)
+	}
+}
+
+// attach flushes the queued messages to a connected connector and adds it to
+// the targets. The flush waits for room in the write queue of c without
+// holding locker, what can't be written because c closed stays queued.
+func (q *sendQueue) attach(c Connector) {
+	target := &sendTarget{pConn: c}
+
+	q.locker.Lock()
+	q.nFlushing++
+	q.locker.Unlock()
+	defer q.flushed()
+
+	for {
+		q.locker.Lock()
+		if len(q.pending) == 0 {
+			q.pending = nil
+			q.targets = append(q.targets, target)
+			q.locker.Unlock()
+			return
+		}
+		msg := q.pending[0]
+		q.pending[0] = pendingMsg{}
+		q.pending = q.pending[1:]
+		q.nBytes -= len(msg.data)
+		q.cFlushed.Broadcast()
+		q.locker.Unlock()
+
+		if !msg.tExpire.IsZero() && time.Now().After(msg.tExpire) {
+			continue
+		}
+		ok, err := target.write(msg.data)
+		if nil != err {
+			logger.Error("flush send queue error: %v", err)
+		}
+		if !ok {
+			q.locker.Lock()
+			q.pending = append([]pendingMsg{msg}, q.pending...)
+			q.nBytes += len(msg.data)
+			q.locker.Unlock()
+			logger.Error("flush send queue error: connection closed")
+			return
+		}
+	}
+}
+
+// flushed wakes the senders waiting for a flush to make room.
+func (q *sendQueue) flushed() {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+
+	q.nFlushing--
+	q.cFlushed.Broadcast()
+}
+
+func (q *sendQueue) detach(c Connector) {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+
+	q.remove(c)
+}
+
+// remove must be called with locker held.
+func (q *sendQueue) remove(c Connector) {
+	for i, target := range q.targets {
+		if target.pConn == c {
+			q.targets = append(q.targets[:i], q.targets[i+1:]...)
+			break
+		}
+	}
+}
+
+// write writes a message once the write queue of the connection has room, ok
+// is false when the connection is closed.
+func (t *sendTarget) write(args ...[]byte) (bool, error) {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+
+	if waiter, ok := t.pConn.(roomWaiter); ok {
+		if nil != waiter.waitRoom() {
+			return false, nil
+		}
+	}
+	return true, t.pConn.WriteMsg(args...)
+}
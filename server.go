@@ -0,0 +1,18 @@
+package go_net
+
+import "context"
+
+// Server is implemented by the servers of every transport, the agents only
+// see the transport through Connector.
+type Server interface {
+	SetNewAgent(newAgent func(Connector) Agent)
+	Start()
+	Shutdown(ctx context.Context) error
+	Close()
+}
+
+var (
+	_ Server = (*TcpServer)(nil)
+	_ Server = (*WSServer)(nil)
+	_ Server = (*GateServer)(nil)
+)
@@ -0,0 +1,99 @@
+package go_net
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hezhis/go_log"
+)
+
+// systemd socket activation passes the sockets from fd 3 on and describes them
+// with LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES, see sd_listen_fds(3).
+const sdListenFdsStart = 3
+
+var (
+	systemdLocker    sync.Mutex
+	systemdOnce      sync.Once
+	systemdListeners map[string][]net.Listener
+)
+
+func loadSystemd() {
+	systemdListeners = make(map[string][]net.Listener)
+
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	// the sockets are meant for the process systemd started, not for children
+	// inheriting its environment
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if nil != err || count <= 0 {
+		return
+	}
+
+	var names []string
+	if s := os.Getenv("LISTEN_FDNAMES"); s != "" {
+		names = strings.Split(s, ":")
+	}
+
+	for i := 0; i < count; i++ {
+		name := "unknown"
+		if i < len(names) {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(sdListenFdsStart+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if nil != err {
+			logger.Error("systemd socket %v error: %v", name, err)
+			continue
+		}
+		systemdListeners[name] = append(systemdListeners[name], ln)
+	}
+}
+
+func takeSystemd(name string) []net.Listener {
+	systemdLocker.Lock()
+	defer systemdLocker.Unlock()
+
+	systemdOnce.Do(loadSystemd)
+	lnList := systemdListeners[name]
+	delete(systemdListeners, name)
+	return lnList
+}
+
+// listenSystemd returns the sockets systemd passed under name, a process
+// started by Restart gets them from its parent instead.
+func listenSystemd(name string) ([]net.Listener, error) {
+	key := "systemd:" + name
+
+	var lnList []net.Listener
+	for i := 0; ; i++ {
+		ln, ok := takeInherited(listenerName(key, i))
+		if !ok {
+			break
+		}
+		lnList = append(lnList, ln)
+	}
+	if len(lnList) == 0 {
+		lnList = takeSystemd(name)
+	}
+	if len(lnList) == 0 {
+		return nil, fmt.Errorf("no systemd socket named %v", name)
+	}
+
+	for i, ln := range lnList {
+		registerListener(listenerName(key, i), ln)
+	}
+	return lnList, nil
+}
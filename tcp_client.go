@@ -1,8 +1,11 @@
 package go_net
 
 import (
+	"context"
+	"errors"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hezhis/go_log"
@@ -10,16 +13,33 @@ import (
 
 type (
 	TcpClient struct {
-		pCreateParam *CreateConnectorParam
-		pLocker      *Locker
+		pCreateParam   *CreateConnectorParam
+		pRetryParam    *RetryParam
+		pEndpointParam *EndpointParam
+		pEndpoints     *endpointSet
+		pSendParam     *SendQueueParam
+		pSendQueue     *sendQueue
+		pSessionParam  *SessionParam
+		pLocker        *Locker
 
 		bClosed          bool
 		bAutoReconnect   bool
 		nConnectInterval time.Duration
-		sRemoteAddr      string
+		nDialTimeout     time.Duration
+		nConnCount       int
+		sNetwork         string
 
-		conn net.Conn
-		wg   sync.WaitGroup
+		connMutex  sync.Mutex
+		connSet    map[net.Conn]struct{}
+		sessionSet map[*tcpSession]struct{}
+		nRunning   int32
+		wg         sync.WaitGroup
+
+		ctx           context.Context
+		cancel        context.CancelFunc
+		cConnected    chan struct{}
+		cDone         chan struct{}
+		connectedOnce sync.Once
 
 		NewAgent func(connector *TcpConnector) Agent
 	}
@@ -27,19 +47,61 @@ type (
 )
 
 func NewTcpClient(opts ...TcpClientOption) *TcpClient {
-	client := &TcpClient{pCreateParam: &CreateConnectorParam{}}
+	client := &TcpClient{
+		pCreateParam:   &CreateConnectorParam{},
+		pRetryParam:    &RetryParam{},
+		pEndpointParam: &EndpointParam{},
+		pSendParam:     &SendQueueParam{},
+	}
 	client.pLocker = NewLocker()
+	client.connSet = make(map[net.Conn]struct{})
+	client.sessionSet = make(map[*tcpSession]struct{})
+	client.cConnected = make(chan struct{})
+	client.cDone = make(chan struct{})
 	for _, opt := range opts {
 		opt(client)
 	}
+	client.pSendQueue = newSendQueue(client.pSendParam)
 	return client
 }
 
+// SetNewAgent sets NewAgent through the transport independent Connector.
+func (c *TcpClient) SetNewAgent(newAgent func(Connector) Agent) {
+	c.NewAgent = func(connector *TcpConnector) Agent {
+		return newAgent(connector)
+	}
+}
+
+// Start is StartContext(context.Background()).
 func (c *TcpClient) Start() {
+	c.StartContext(context.Background())
+}
+
+// StartContext starts the client, dialing and backoff stop as soon as ctx ends
+// and the current connection is closed.
+func (c *TcpClient) StartContext(ctx context.Context) {
 	c.init()
+	c.ctx, c.cancel = context.WithCancel(ctx)
 
-	c.wg.Add(1)
-	go c.connect()
+	c.wg.Add(1 + c.nConnCount)
+	c.nRunning = int32(c.nConnCount)
+	go c.watch()
+	for i := 0; i < c.nConnCount; i++ {
+		go c.connect()
+	}
+}
+
+// WaitConnected blocks until the first connection is established, the client
+// stops connecting or ctx ends.
+func (c *TcpClient) WaitConnected(ctx context.Context) error {
+	select {
+	case <-c.cConnected:
+		return nil
+	case <-c.cDone:
+		return ErrClientClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (c *TcpClient) init() {
@@ -59,67 +121,222 @@ func (c *TcpClient) init() {
 		c.nConnectInterval = 3 * time.Second
 	}
 
+	if nil == c.pRetryParam.pBackoff {
+		c.pRetryParam.pBackoff = &ConstantBackoff{Interval: c.nConnectInterval}
+	}
+
+	if len(c.pEndpointParam.asAddrs) == 0 && nil == c.pEndpointParam.pResolver {
+		logger.Fatal("remote addr must not be empty")
+	}
+	if c.nConnCount <= 0 {
+		c.nConnCount = 1
+	}
+	if c.sNetwork == "" {
+		c.sNetwork = "tcp"
+	}
+	c.pEndpoints = newEndpointSet(c.pEndpointParam)
+
+	if nil != c.pSessionParam {
+		if c.pSessionParam.nGrace <= 0 {
+			c.pSessionParam.nGrace = 30 * time.Second
+		}
+		if c.pSessionParam.nReplayCap <= 0 {
+			c.pSessionParam.nReplayCap = 1024
+		}
+	}
 }
 
-func (c *TcpClient) dial() net.Conn {
+func (c *TcpClient) watch() {
+	defer c.wg.Done()
+
+	<-c.ctx.Done()
+	c.shutdown()
+}
+
+// dial connects to one of the endpoints, handshake runs on the new connection
+// when not nil and its failure counts as a dial error.
+func (c *TcpClient) dial(ctx context.Context, retry *retryState, handshake func(net.Conn) error) (net.Conn, *endpoint) {
+	dialer := net.Dialer{Timeout: c.nDialTimeout}
 	for {
-		conn, err := net.Dial("tcp", c.sRemoteAddr)
-		if err == nil || c.bClosed {
-			return conn
+		c.pEndpoints.resolve(ctx)
+		ep := c.pEndpoints.pick()
+		if nil == ep {
+			logger.Error("connect error: %v", ErrNoEndpoint)
+			delay, ok := retry.dialFailed("", ErrNoEndpoint)
+			if !ok || !sleepContext(ctx, delay) {
+				return nil, nil
+			}
+			continue
+		}
+		conn, err := dialer.DialContext(ctx, c.sNetwork, ep.sAddr)
+		if nil == err && nil != handshake {
+			if err = handshake(conn); nil != err {
+				conn.Close()
+			}
+		}
+		if nil == err {
+			return conn, ep
+		}
+		if nil != ctx.Err() || errors.Is(err, ErrSessionExpired) {
+			c.pEndpoints.disconnected(ep)
+			return nil, nil
 		}
 
-		logger.Error("connect to %v error: %v", c.sRemoteAddr, err)
-		time.Sleep(c.nConnectInterval)
-		continue
+		logger.Error("connect to %v error: %v", ep.sAddr, err)
+		c.pEndpoints.dialFailed(ep)
+		delay, ok := retry.dialFailed(ep.sAddr, err)
+		if !ok || !sleepContext(ctx, delay) {
+			return nil, nil
+		}
+	}
+}
+
+// resume reconnects a session whose link was lost until the session is
+// resumed, rejected by the server or its grace period lapses.
+func (c *TcpClient) resume(session *tcpSession) {
+	defer c.wg.Done()
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+	if !session.notifyExpired(cancel) {
+		return
 	}
+
+	codec := newFrameCodec(c.pCreateParam)
+	conn, ep := c.dial(ctx, newRetryState(c.pRetryParam), func(conn net.Conn) error {
+		_, peerRecv, resumed, err := clientHandshake(conn, &codec, session.token, session.recvSeq())
+		if nil != err {
+			return err
+		}
+		if !resumed || !session.attach(conn, peerRecv, nil) {
+			return ErrSessionExpired
+		}
+		return nil
+	})
+	if nil == conn {
+		session.expire()
+		return
+	}
+	c.pEndpoints.disconnected(ep)
 }
 
 func (c *TcpClient) connect() {
 	defer c.wg.Done()
+	defer func() {
+		if atomic.AddInt32(&c.nRunning, -1) == 0 {
+			close(c.cDone)
+		}
+	}()
+
+	retry := newRetryState(c.pRetryParam)
+
+	var session *tcpSession
+	var handshake func(net.Conn) error
+	if nil != c.pSessionParam {
+		codec := newFrameCodec(c.pCreateParam)
+		handshake = func(conn net.Conn) error {
+			token, _, _, err := clientHandshake(conn, &codec, sessionToken{}, 0)
+			if nil == err {
+				session = newTcpSession(token, c.pSessionParam, conn)
+			}
+			return err
+		}
+	}
 
 reconnect:
-	conn := c.dial()
+	conn, ep := c.dial(c.ctx, retry, handshake)
 	if conn == nil {
 		return
 	}
 
-	c.pLocker.Lock()
+	c.connMutex.Lock()
 	if c.bClosed {
-		c.pLocker.Unlock()
+		c.connMutex.Unlock()
 		conn.Close()
+		c.pEndpoints.disconnected(ep)
 		return
 	}
-	c.conn = conn
-	c.pLocker.Unlock()
+	c.connSet[conn] = struct{}{}
+	if nil != session {
+		c.sessionSet[session] = struct{}{}
+		s := session
+		s.onLost = func() {
+			// the session is in sessionSet until connect cleans up, which
+			// keeps wg above zero for the Add
+			c.connMutex.Lock()
+			defer c.connMutex.Unlock()
+			if _, ok := c.sessionSet[s]; ok {
+				c.wg.Add(1)
+				go c.resume(s)
+			}
+		}
+	}
+	c.connMutex.Unlock()
+	c.pEndpoints.connected(ep)
 
-	tcpConn := newTcpConnector(conn, c.pCreateParam)
+	c.connectedOnce.Do(func() {
+		close(c.cConnected)
+	})
+
+	connectedAt := time.Now()
+	tcpConn := newTcpConnector(conn, c.pCreateParam, session)
 	agent := c.NewAgent(tcpConn)
+	c.pSendQueue.attach(tcpConn)
 	agent.LogicRun()
+	c.pSendQueue.detach(tcpConn)
 
 	// cleanup
 	tcpConn.Close()
-	c.pLocker.Lock()
-	c.conn = nil
-	c.pLocker.Unlock()
+	c.connMutex.Lock()
+	delete(c.connSet, conn)
+	if nil != session {
+		delete(c.sessionSet, session)
+		session = nil
+	}
+	c.connMutex.Unlock()
+	c.pEndpoints.disconnected(ep)
 	agent.OnClose()
 
-	if c.bAutoReconnect {
-		time.Sleep(c.nConnectInterval)
+	if c.bAutoReconnect && nil == c.ctx.Err() {
+		delay, ok := retry.disconnected(time.Since(connectedAt))
+		if !ok || !sleepContext(c.ctx, delay) {
+			return
+		}
 		goto reconnect
 	}
 }
 
-func (c *TcpClient) Close() {
-	c.pLocker.Lock()
+// Send writes a message through one of the connections, while the client is
+// disconnected messages are queued and flushed in order after reconnecting.
+// Delivery is at most once, a message handed to a connection is lost when the
+// connection drops before writing it.
+func (c *TcpClient) Send(args ...[]byte) error {
+	return c.pSendQueue.send(args...)
+}
+
+func (c *TcpClient) shutdown() {
+	c.connMutex.Lock()
+	defer c.connMutex.Unlock()
 
 	if !c.bClosed {
 		c.bClosed = true
-		if nil != c.conn {
-			c.conn.Close()
-			c.conn = nil
+		for session := range c.sessionSet {
+			session.expire()
 		}
+		c.sessionSet = nil
+		for conn := range c.connSet {
+			conn.Close()
+		}
+		c.connSet = nil
+	}
+}
+
+func (c *TcpClient) Close() {
+	if nil != c.cancel {
+		c.cancel()
 	}
-	c.pLocker.Unlock()
+	c.shutdown()
 
 	c.wg.Wait()
+	closeResolver(c.pEndpointParam.pResolver)
 }
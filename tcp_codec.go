@@ -0,0 +1,124 @@
+package go_net
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// frameCodec holds the length-prefix rules of a tcp connection.
+type frameCodec struct {
+	bLittleEndian bool
+	nHeadLength   int
+	nMaxMsgLength uint32
+}
+
+// newFrameCodec takes the rules from param, the connections of a client share
+// it so the defaults are not written back.
+func newFrameCodec(param *CreateConnectorParam) frameCodec {
+	headLength := param.nHeadLength
+	if 0 == headLength {
+		headLength = 2
+	}
+
+	var max uint32
+	switch headLength {
+	case 2:
+		max = math.MaxUint16
+	case 4:
+		max = math.MaxUint32
+	}
+	if max > param.nMaxMsgLength {
+		max = param.nMaxMsgLength
+	}
+
+	return frameCodec{
+		bLittleEndian: param.bLittleEndian,
+		nHeadLength:   headLength,
+		nMaxMsgLength: max,
+	}
+}
+
+func (f *frameCodec) msgLen(header []byte) uint32 {
+	switch f.nHeadLength {
+	case 2:
+		if f.bLittleEndian {
+			return uint32(binary.LittleEndian.Uint16(header))
+		}
+		return uint32(binary.BigEndian.Uint16(header))
+	case 4:
+		if f.bLittleEndian {
+			return binary.LittleEndian.Uint32(header)
+		}
+		return binary.BigEndian.Uint32(header)
+	}
+	return 0
+}
+
+func (f *frameCodec) putMsgLen(header []byte, msgLen uint32) {
+	switch f.nHeadLength {
+	case 2:
+		if f.bLittleEndian {
+			binary.LittleEndian.PutUint16(header, uint16(msgLen))
+		} else {
+			binary.BigEndian.PutUint16(header, uint16(msgLen))
+		}
+	case 4:
+		if f.bLittleEndian {
+			binary.LittleEndian.PutUint32(header, msgLen)
+		} else {
+			binary.BigEndian.PutUint32(header, msgLen)
+		}
+	}
+}
+
+// read reads one frame, header must be nHeadLength bytes long.
+func (f *frameCodec) read(r io.Reader, header []byte) ([]byte, error) {
+	// read len
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	msgLen := f.msgLen(header)
+
+	// check len
+	if msgLen > f.nMaxMsgLength {
+		return nil, errors.New("message too long")
+	}
+
+	// data
+	msgData := make([]byte, msgLen)
+	if _, err := io.ReadFull(r, msgData); err != nil {
+		return nil, err
+	}
+
+	return msgData, nil
+}
+
+// pack merges args into one frame with the length prefix.
+func (f *frameCodec) pack(args ...[]byte) ([]byte, error) {
+	// get len
+	var msgLen uint32
+	for i := 0; i < len(args); i++ {
+		msgLen += uint32(len(args[i]))
+	}
+
+	// check len
+	if msgLen > f.nMaxMsgLength {
+		return nil, errors.New("message too long")
+	}
+
+	msg := make([]byte, uint32(f.nHeadLength)+msgLen)
+
+	// write len
+	f.putMsgLen(msg, msgLen)
+
+	// write data
+	l := f.nHeadLength
+	for i := 0; i < len(args); i++ {
+		copy(msg[l:], args[i])
+		l += len(args[i])
+	}
+
+	return msg, nil
+}
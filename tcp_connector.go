@@ -1,28 +1,33 @@
 package go_net
 
 import (
-	"encoding/binary"
-	"errors"
-	"io"
-	"math"
 	"net"
+	"sync"
 
 	"github.com/hezhis/go_log"
 )
 
 type (
 	TcpConnector struct {
-		conn net.Conn
+		frameCodec
 
-		bClosed       bool
-		bLittleEndian bool
-		nHeadLength   int
-		nMaxMsgLength uint32
+		conn     net.Conn
+		pSession *tcpSession
+
+		bClosed bool
+
+		nMaxStreamLength int64
 
 		pLocker *Locker
 
+		// messages written while a stream is open wait in held for its end
+		streamLocker sync.Mutex
+		bStreaming   bool
+		held         [][]byte
+
 		bHeader        []byte
 		cWriteBuffChan chan []byte
+		cDrained       chan struct{}
 	}
 
 	CreateConnectorParam struct {
@@ -30,37 +35,35 @@ type (
 		nWriteBuffCap int
 		nMaxMsgLength uint32
 		bLittleEndian bool
+		pCompress     *CompressParam // websocket only
+
+		nMaxStreamLength int64 // 0 means no limit
 	}
 )
 
-func newTcpConnector(conn net.Conn, param *CreateConnectorParam) *TcpConnector {
+// newTcpConnector creates the connector of conn, session is nil unless the
+// connection uses the resumable session protocol.
+func newTcpConnector(conn net.Conn, param *CreateConnectorParam, session *tcpSession) *TcpConnector {
 	c := &TcpConnector{}
 	c.pLocker = NewLocker()
 	c.conn = conn
+	c.pSession = session
 
-	if 0 == param.nHeadLength {
-		param.nHeadLength = 2
-	}
-	if 0 == param.nWriteBuffCap {
-		param.nWriteBuffCap = 1024
+	// the connections of a client share param
+	writeBuffCap := param.nWriteBuffCap
+	if 0 == writeBuffCap {
+		writeBuffCap = 1024
 	}
 
-	var max uint32
-	switch param.nHeadLength {
-	case 2:
-		max = math.MaxUint16
-	case 4:
-		max = math.MaxUint32
-	}
-	if max > param.nMaxMsgLength {
-		max = param.nMaxMsgLength
-	}
+	c.frameCodec = newFrameCodec(param)
+	c.nMaxStreamLength = param.nMaxStreamLength
+	c.bHeader = make([]byte, c.nHeadLength)
+	c.cWriteBuffChan = make(chan []byte, writeBuffCap)
+	c.cDrained = make(chan struct{}, 1)
 
-	c.nMaxMsgLength = max
-	c.nHeadLength = param.nHeadLength
-	c.bLittleEndian = param.bLittleEndian
-	c.bHeader = make([]byte, param.nHeadLength)
-	c.cWriteBuffChan = make(chan []byte, param.nWriteBuffCap)
+	if nil != session {
+		session.pConnector = c
+	}
 
 	go c.startWriter(conn)
 
@@ -68,24 +71,41 @@ func newTcpConnector(conn net.Conn, param *CreateConnectorParam) *TcpConnector {
 }
 
 func (c *TcpConnector) startWriter(conn net.Conn) {
-	for b := range c.cWriteBuffChan {
-		if b == nil {
-			break
+	if nil != c.pSession {
+		c.pSession.runWriter(c)
+	} else {
+		for b := range c.cWriteBuffChan {
+			if b == nil {
+				break
+			}
+
+			if _, err := conn.Write(b); nil != err {
+				logger.Error("write data error! %v", err)
+				break
+			}
+			notifyDrained(c.cDrained)
 		}
 
-		if _, err := conn.Write(b); nil != err {
-			logger.Error("write data error! %v", err)
-			break
-		}
+		conn.Close()
 	}
-
-	conn.Close()
+	close(c.cDrained)
 
 	c.pLocker.Lock()
 	c.bClosed = true
 	c.pLocker.Unlock()
 }
 
+// waitRoom waits until the write queue holds less than roomQueueLength
+// messages, it fails once the connection is closed.
+func (c *TcpConnector) waitRoom() error {
+	for len(c.cWriteBuffChan) >= roomQueueLength(cap(c.cWriteBuffChan)) {
+		if _, ok := <-c.cDrained; !ok {
+			return ErrConnClosed
+		}
+	}
+	return drainedOpen(c.cDrained)
+}
+
 func (c *TcpConnector) Write(b []byte) {
 	if nil == b {
 		return
@@ -129,8 +149,14 @@ func (c *TcpConnector) Destroy() {
 }
 
 func (c *TcpConnector) doDestroy() {
-	c.conn.(*net.TCPConn).SetLinger(0)
-	c.conn.Close()
+	if nil != c.pSession {
+		c.pSession.expire()
+	} else {
+		if tcpConn, ok := c.conn.(*net.TCPConn); ok {
+			tcpConn.SetLinger(0)
+		}
+		c.conn.Close()
+	}
 
 	if !c.bClosed {
 		close(c.cWriteBuffChan)
@@ -139,84 +165,47 @@ func (c *TcpConnector) doDestroy() {
 }
 
 func (c *TcpConnector) LocalAddr() net.Addr {
+	if nil != c.pSession {
+		return c.pSession.lastLink().LocalAddr()
+	}
 	return c.conn.LocalAddr()
 }
 
 func (c *TcpConnector) RemoteAddr() net.Addr {
+	if nil != c.pSession {
+		return c.pSession.lastLink().RemoteAddr()
+	}
 	return c.conn.RemoteAddr()
 }
 
 func (c *TcpConnector) ReadMsg() ([]byte, error) {
-	// read len
-	if _, err := io.ReadFull(c.conn, c.bHeader); err != nil {
-		return nil, err
-	}
-
-	var msgLen uint32
-	switch c.nHeadLength {
-	case 2:
-		if c.bLittleEndian {
-			msgLen = uint32(binary.LittleEndian.Uint16(c.bHeader))
-		} else {
-			msgLen = uint32(binary.BigEndian.Uint16(c.bHeader))
-		}
-	case 4:
-		if c.bLittleEndian {
-			msgLen = binary.LittleEndian.Uint32(c.bHeader)
-		} else {
-			msgLen = binary.BigEndian.Uint32(c.bHeader)
-		}
-	}
-
-	// check len
-	if msgLen > c.nMaxMsgLength {
-		return nil, errors.New("message too long")
+	if nil != c.pSession {
+		return c.pSession.readMsg(c)
 	}
-
-	// data
-	msgData := make([]byte, msgLen)
-	if _, err := io.ReadFull(c.conn, msgData); err != nil {
-		return nil, err
-	}
-
-	return msgData, nil
+	return c.read(c.conn, c.bHeader)
 }
 
+// WriteMsg writes a message, while a stream is written the message is sent
+// after the stream.
 func (c *TcpConnector) WriteMsg(args ...[]byte) error {
-	// get len
-	var msgLen uint32
-	for i := 0; i < len(args); i++ {
-		msgLen += uint32(len(args[i]))
-	}
+	c.streamLocker.Lock()
+	defer c.streamLocker.Unlock()
 
-	// check len
-	if msgLen > c.nMaxMsgLength {
-		return errors.New("message too long")
+	if c.bStreaming {
+		return c.hold(args...)
 	}
+	return c.writeMsg(args...)
+}
 
-	msg := make([]byte, uint32(c.nHeadLength)+msgLen)
-
-	// write len
-	switch c.nHeadLength {
-	case 2:
-		if c.bLittleEndian {
-			binary.LittleEndian.PutUint16(msg, uint16(msgLen))
-		} else {
-			binary.BigEndian.PutUint16(msg, uint16(msgLen))
-		}
-	case 4:
-		if c.bLittleEndian {
-			binary.LittleEndian.PutUint32(msg, msgLen)
-		} else {
-			binary.BigEndian.PutUint32(msg, msgLen)
-		}
+// writeMsg must be called with streamLocker held.
+func (c *TcpConnector) writeMsg(args ...[]byte) error {
+	if nil != c.pSession {
+		return c.pSession.writeMsg(c, args...)
 	}
 
-	// write data
-	l := c.nHeadLength
-	for i := 0; i < len(args); i++ {
-		copy(msg[l:], args[i])
-		l += len(args[i])
+	msg, err := c.pack(args...)
+	if nil != err {
+		return err
 	}
 
 	c.Write(msg)
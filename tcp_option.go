@@ -11,6 +11,38 @@ func TcpSLocalAddr(addr string) TcpServerOption {
 	}
 }
 
+// TcpSNetwork sets the network of the listen addrs, tcp by default, tcp4,
+// tcp6 and unix are accepted as well.
+func TcpSNetwork(network string) TcpServerOption {
+	return func(s *TcpServer) {
+		s.sNetwork = network
+	}
+}
+
+// TcpSListen listens on another addr besides the local addr, opts set the
+// tls and the client limit of that listener.
+func TcpSListen(addr string, opts ...ListenOption) TcpServerOption {
+	return func(s *TcpServer) {
+		s.listenParams = append(s.listenParams, newListenParam(addr, opts...))
+	}
+}
+
+// TcpSReusePort opens count listeners on every listen addr with SO_REUSEPORT,
+// each one with its own accept loop.
+func TcpSReusePort(count int) TcpServerOption {
+	return func(s *TcpServer) {
+		s.nReusePort = count
+	}
+}
+
+// TcpSSystemdName takes the listeners from systemd socket activation, name is
+// the FileDescriptorName of the socket unit, the local addr is ignored.
+func TcpSSystemdName(name string) TcpServerOption {
+	return func(s *TcpServer) {
+		s.sSystemdName = name
+	}
+}
+
 func TcpSHeadLen(length int) TcpServerOption {
 	return func(s *TcpServer) {
 		s.pCreateParam.nHeadLength = length
@@ -29,6 +61,13 @@ func TcpSMaxMsgLen(length uint32) TcpServerOption {
 	}
 }
 
+// TcpSMaxStreamLen limits the messages read with ReadStream, 0 means no limit.
+func TcpSMaxStreamLen(length int64) TcpServerOption {
+	return func(s *TcpServer) {
+		s.pCreateParam.nMaxStreamLength = length
+	}
+}
+
 func TcpSWriteBuffCap(cap int) TcpServerOption {
 	return func(s *TcpServer) {
 		s.pCreateParam.nWriteBuffCap = cap
@@ -41,12 +80,58 @@ func TcpSLittleEndian(flag bool) TcpServerOption {
 	}
 }
 
+// TcpSSession enables resumable sessions, a client may resume within grace
+// and up to replayCap unacknowledged messages are kept for retransmission.
+func TcpSSession(grace time.Duration, replayCap int) TcpServerOption {
+	return func(s *TcpServer) {
+		s.pSessionParam = &SessionParam{nGrace: grace, nReplayCap: replayCap}
+	}
+}
+
 ////////////////////////////////////////////
 // client
 
 func TcpCRemoteAddr(addr string) TcpClientOption {
 	return func(c *TcpClient) {
-		c.sRemoteAddr = addr
+		c.pEndpointParam.asAddrs = []string{addr}
+	}
+}
+
+func TcpCRemoteAddrs(addrs ...string) TcpClientOption {
+	return func(c *TcpClient) {
+		c.pEndpointParam.asAddrs = addrs
+	}
+}
+
+// TcpCResolver sets a resolver consulted before every dial, addresses from
+// TcpCRemoteAddr/TcpCRemoteAddrs are used until it returns a list. The client
+// closes r on Close when it implements io.Closer.
+func TcpCResolver(r Resolver) TcpClientOption {
+	return func(c *TcpClient) {
+		c.pEndpointParam.pResolver = r
+	}
+}
+
+func TcpCBalance(strategy BalanceStrategy) TcpClientOption {
+	return func(c *TcpClient) {
+		c.pEndpointParam.nStrategy = strategy
+	}
+}
+
+// TcpCEject takes an endpoint out of rotation for duration after failures
+// consecutive failed dials. The connections established to an endpoint don't
+// affect it.
+func TcpCEject(failures int, duration time.Duration) TcpClientOption {
+	return func(c *TcpClient) {
+		c.pEndpointParam.nEjectFailures = failures
+		c.pEndpointParam.nEjectDuration = duration
+	}
+}
+
+// TcpCConnCount sets how many connections the client keeps, spread over the endpoints.
+func TcpCConnCount(count int) TcpClientOption {
+	return func(c *TcpClient) {
+		c.nConnCount = count
 	}
 }
 
@@ -56,6 +141,19 @@ func TcpCConnectInterval(interval time.Duration) TcpClientOption {
 	}
 }
 
+// TcpCNetwork sets the network of the remote addrs, tcp by default.
+func TcpCNetwork(network string) TcpClientOption {
+	return func(c *TcpClient) {
+		c.sNetwork = network
+	}
+}
+
+func TcpCDialTimeout(timeout time.Duration) TcpClientOption {
+	return func(c *TcpClient) {
+		c.nDialTimeout = timeout
+	}
+}
+
 func TcpCAutoReconnect(b bool) TcpClientOption {
 	return func(c *TcpClient) {
 		c.bAutoReconnect = b
@@ -74,6 +172,13 @@ func TcpCMaxMsgLen(length uint32) TcpClientOption {
 	}
 }
 
+// TcpCMaxStreamLen limits the messages read with ReadStream, 0 means no limit.
+func TcpCMaxStreamLen(length int64) TcpClientOption {
+	return func(c *TcpClient) {
+		c.pCreateParam.nMaxStreamLength = length
+	}
+}
+
 func TcpCWriteBuffCap(cap int) TcpClientOption {
 	return func(c *TcpClient) {
 		c.pCreateParam.nWriteBuffCap = cap
@@ -85,3 +190,50 @@ func TcpCLittleEndian(flag bool) TcpClientOption {
 		c.pCreateParam.bLittleEndian = flag
 	}
 }
+
+func TcpCBackoff(b Backoff) TcpClientOption {
+	return func(c *TcpClient) {
+		c.pRetryParam.pBackoff = b
+	}
+}
+
+func TcpCBackoffResetAfter(uptime time.Duration) TcpClientOption {
+	return func(c *TcpClient) {
+		c.pRetryParam.nResetAfter = uptime
+	}
+}
+
+func TcpCOnDialError(f func(addr string, attempt int, err error)) TcpClientOption {
+	return func(c *TcpClient) {
+		c.pRetryParam.onDialError = f
+	}
+}
+
+func TcpCOnGiveUp(f func(attempts int, lastErr error)) TcpClientOption {
+	return func(c *TcpClient) {
+		c.pRetryParam.onGiveUp = f
+	}
+}
+
+// TcpCSession enables resumable sessions, the server must enable them too.
+func TcpCSession(grace time.Duration, replayCap int) TcpClientOption {
+	return func(c *TcpClient) {
+		c.pSessionParam = &SessionParam{nGrace: grace, nReplayCap: replayCap}
+	}
+}
+
+// TcpCSendQueue bounds the messages Send queues while disconnected, zero
+// maxBytes or ttl means no limit.
+func TcpCSendQueue(maxCount, maxBytes int, ttl time.Duration) TcpClientOption {
+	return func(c *TcpClient) {
+		c.pSendParam.nMaxCount = maxCount
+		c.pSendParam.nMaxBytes = maxBytes
+		c.pSendParam.nTTL = ttl
+	}
+}
+
+func TcpCSendOverflow(policy OverflowPolicy) TcpClientOption {
+	return func(c *TcpClient) {
+		c.pSendParam.nPolicy = policy
+	}
+}
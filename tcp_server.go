@@ -1,6 +1,9 @@
 package go_net
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"net"
 	"sync"
 	"time"
@@ -12,21 +15,36 @@ const (
 	acceptDelayMax = time.Second
 )
 
+var (
+	ErrServerClosed   = errors.New("server closed")
+	ErrTooManyClients = errors.New("too many connections")
+)
+
 type (
 	TcpServerOption func(s *TcpServer)
 
 	TcpServer struct {
-		ln     net.Listener
-		lnWait sync.WaitGroup
+		initOnce sync.Once
+		bClosed  bool
+
+		lnList       []*serverListener
+		lnWait       sync.WaitGroup
+		listenParams []*ListenParam
 
-		connWait  sync.WaitGroup
-		connMutex sync.Mutex
-		connSet   map[net.Conn]struct{}
+		connWait   sync.WaitGroup
+		connMutex  sync.Mutex
+		connSet    map[net.Conn]*serverListener
+		sessionSet map[sessionToken]*tcpSession
+		linkSet    map[*tcpSession]net.Conn // the connSet entry standing for a session
 
-		pCreateParam *CreateConnectorParam
+		pCreateParam  *CreateConnectorParam
+		pSessionParam *SessionParam
 
 		nMaxClientCount int
+		nReusePort      int
+		sNetwork        string
 		sLocalHost      string
+		sSystemdName    string
 
 		NewAgent func(connector *TcpConnector) Agent
 	}
@@ -40,9 +58,60 @@ func NewTcpServer(opts ...TcpServerOption) *TcpServer {
 	return s
 }
 
+// SetNewAgent sets NewAgent through the transport independent Connector.
+func (s *TcpServer) SetNewAgent(newAgent func(Connector) Agent) {
+	s.NewAgent = func(connector *TcpConnector) Agent {
+		return newAgent(connector)
+	}
+}
+
 func (s *TcpServer) Start() {
-	s.init()
-	go s.logicRun()
+	s.initOnce.Do(s.init)
+
+	lnList, err := s.listen()
+	if nil != err {
+		logger.Fatal("tcp server listen error! %v", err)
+	}
+
+	for _, ln := range lnList {
+		if !s.addListener(ln) {
+			ln.close()
+			continue
+		}
+		go s.logicRun(ln)
+	}
+}
+
+// Serve accepts connections on a listener created by the caller until the
+// listener fails or the server is closed.
+func (s *TcpServer) Serve(ln net.Listener) error {
+	s.initOnce.Do(s.init)
+
+	l := newServerListener(ln, &ListenParam{}, nil)
+	if !s.addListener(l) {
+		return ErrServerClosed
+	}
+	err := s.logicRun(l)
+
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	if s.bClosed {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// ServeConn serves a connection accepted by the caller, it returns once the
+// agent of the connection finished.
+func (s *TcpServer) ServeConn(conn net.Conn) error {
+	s.initOnce.Do(s.init)
+
+	if err := s.addConn(conn, nil); nil != err {
+		conn.Close()
+		return err
+	}
+	s.serveConn(conn)
+	return nil
 }
 
 func (s *TcpServer) init() {
@@ -59,11 +128,6 @@ func (s *TcpServer) init() {
 		logger.Warn("invalid MaxMsgLen, reset to %v", s.pCreateParam.nMaxMsgLength)
 	}
 
-	ln, err := net.Listen("tcp", s.sLocalHost)
-	if nil != err {
-		logger.Fatal("tcp server listen error!", err)
-	}
-
 	if s.nMaxClientCount <= 0 {
 		s.nMaxClientCount = 100
 		logger.Info("invalid nMaxClientCount, reset to %v", s.nMaxClientCount)
@@ -74,69 +138,342 @@ func (s *TcpServer) init() {
 		logger.Info("invalid nWriteBuffCap, reset to %v", s.pCreateParam.nWriteBuffCap)
 	}
 
-	s.ln = ln
-	s.connSet = make(map[net.Conn]struct{})
+	if nil != s.pSessionParam {
+		if s.pSessionParam.nGrace <= 0 {
+			s.pSessionParam.nGrace = 30 * time.Second
+		}
+		if s.pSessionParam.nReplayCap <= 0 {
+			s.pSessionParam.nReplayCap = 1024
+		}
+	}
+
+	s.connSet = make(map[net.Conn]*serverListener)
+	s.sessionSet = make(map[sessionToken]*tcpSession)
+	s.linkSet = make(map[*tcpSession]net.Conn)
 }
 
-func (s *TcpServer) logicRun() {
+// removeConn must be called with connMutex held.
+func (s *TcpServer) removeConn(conn net.Conn) {
+	ln, ok := s.connSet[conn]
+	if !ok {
+		return
+	}
+	delete(s.connSet, conn)
+	if nil != ln {
+		ln.release()
+	}
+}
+
+// removeLink frees the slot of the current link of session, it must be called
+// with connMutex held.
+func (s *TcpServer) removeLink(session *tcpSession) {
+	if conn, ok := s.linkSet[session]; ok {
+		s.removeConn(conn)
+		delete(s.linkSet, session)
+	}
+}
+
+// listen opens the listeners of the local addr and of every TcpSListen addr.
+// The local addr is taken from systemd socket activation when a systemd name
+// is set.
+func (s *TcpServer) listen() ([]*serverListener, error) {
+	var lnList []*serverListener
+	add := func(raws []net.Listener, param *ListenParam) error {
+		config, err := param.tlsConfig()
+		if nil != err {
+			closeRawListeners(raws)
+			return err
+		}
+		for _, raw := range raws {
+			lnList = append(lnList, newServerListener(raw, param, config))
+		}
+		return nil
+	}
+
+	primary := &ListenParam{sAddr: s.sLocalHost}
+	var err error
+	if s.sSystemdName != "" {
+		var raws []net.Listener
+		if raws, err = listenSystemd(s.sSystemdName); nil == err {
+			err = add(raws, primary)
+		}
+	} else if s.sLocalHost != "" || len(s.listenParams) == 0 {
+		var raws []net.Listener
+		if raws, err = s.listenAddr(s.sLocalHost); nil == err {
+			err = add(raws, primary)
+		}
+	}
+
+	for _, param := range s.listenParams {
+		if nil != err {
+			break
+		}
+		var raws []net.Listener
+		if raws, err = s.listenAddr(param.sAddr); nil == err {
+			err = add(raws, param)
+		}
+	}
+
+	if nil != err {
+		closeServerListeners(lnList)
+		return nil, err
+	}
+	return lnList, nil
+}
+
+// listenAddr opens the listener of addr, or nReusePort listeners sharing it
+// through SO_REUSEPORT so the kernel spreads new connections over them.
+// Listeners handed over by a restarting parent process are used first.
+func (s *TcpServer) listenAddr(addr string) ([]net.Listener, error) {
+	network := s.sNetwork
+	if network == "" {
+		network = "tcp"
+	}
+
+	count := s.nReusePort
+	if count < 1 || network == "unix" {
+		count = 1
+	}
+
+	lc := net.ListenConfig{}
+	if count > 1 {
+		lc.Control = reusePortControl
+	}
+
+	host := addr
+	lnList := make([]net.Listener, 0, count)
+	for i := 0; i < count; i++ {
+		name := listenerName(addr, i)
+		ln, ok := takeInherited(name)
+		if !ok {
+			var err error
+			if ln, err = lc.Listen(context.Background(), network, host); nil != err {
+				closeRawListeners(lnList)
+				return nil, err
+			}
+		}
+		// a zero port is chosen by the first listener, the others must share it
+		host = ln.Addr().String()
+		registerListener(name, ln)
+		lnList = append(lnList, ln)
+	}
+	return lnList, nil
+}
+
+func (s *TcpServer) addListener(ln *serverListener) bool {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+
+	if s.bClosed {
+		return false
+	}
+	s.lnList = append(s.lnList, ln)
 	s.lnWait.Add(1)
+	return true
+}
+
+// addConn registers conn accepted on ln, ln is nil for ServeConn.
+func (s *TcpServer) addConn(conn net.Conn, ln *serverListener) error {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+
+	if s.bClosed {
+		return ErrServerClosed
+	}
+	if len(s.connSet) >= s.nMaxClientCount || (nil != ln && !ln.acquire()) {
+		return ErrTooManyClients
+	}
+	s.connSet[conn] = ln
+	s.connWait.Add(1)
+	return nil
+}
+
+// nextAcceptDelay backs off an accept loop hitting temporary errors such as
+// running out of file descriptors.
+func nextAcceptDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		delay = 5 * time.Millisecond
+	} else {
+		delay *= 2
+	}
+	if delay > acceptDelayMax {
+		delay = acceptDelayMax
+	}
+	return delay
+}
+
+func (s *TcpServer) logicRun(ln *serverListener) error {
 	defer s.lnWait.Done()
 
 	var delay time.Duration
 	for {
-		conn, err := s.ln.Accept()
+		conn, err := ln.Accept()
 		if nil != err {
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
-				if delay == 0 {
-					delay = 5 * time.Millisecond
-				} else {
-					delay *= 2
-				}
-				if delay > acceptDelayMax {
-					delay = acceptDelayMax
-				}
+				delay = nextAcceptDelay(delay)
 				time.Sleep(delay)
 				continue
 			}
-			return
+			return err
 		}
 		delay = 0
 
-		s.connMutex.Lock()
-		if len(s.connSet) >= s.nMaxClientCount {
-			logger.Error("too many connections")
-			s.connMutex.Unlock()
+		if err := s.addConn(conn, ln); nil != err {
+			logger.Error("refuse connection from %v: %v", conn.RemoteAddr(), err)
 			conn.Close()
 			continue
 		}
-		s.connSet[conn] = struct{}{}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *TcpServer) serveConn(conn net.Conn) {
+	defer s.connWait.Done()
+
+	var session *tcpSession
+	if nil != s.pSessionParam {
+		var resumed bool
+		session, resumed = s.handshake(conn)
+		if nil == session {
+			s.connMutex.Lock()
+			s.removeConn(conn)
+			s.connMutex.Unlock()
+			conn.Close()
+			return
+		}
+		if resumed {
+			// a resumed connection belongs to the agent of its session, it
+			// keeps its slot so the limits count the session's live link
+			s.connMutex.Lock()
+			s.removeLink(session)
+			if _, ok := s.sessionSet[session.token]; ok {
+				s.linkSet[session] = conn
+			} else {
+				s.removeConn(conn)
+			}
+			s.connMutex.Unlock()
+			return
+		}
+
+		s.connMutex.Lock()
+		if nil != s.linkSet {
+			s.linkSet[session] = conn
+		}
 		s.connMutex.Unlock()
+	}
 
-		s.connWait.Add(1)
+	connector := newTcpConnector(conn, s.pCreateParam, session)
+	agent := s.NewAgent(connector)
+	agent.LogicRun()
 
-		connector := newTcpConnector(conn, s.pCreateParam)
-		agent := s.NewAgent(connector)
-		go func() {
-			agent.LogicRun()
+	connector.Close()
 
-			connector.Close()
+	s.connMutex.Lock()
+	if nil != session {
+		s.removeLink(session)
+		delete(s.sessionSet, session.token)
+	} else {
+		s.removeConn(conn)
+	}
+	s.connMutex.Unlock()
 
-			s.connMutex.Lock()
-			delete(s.connSet, conn)
-			s.connMutex.Unlock()
+	agent.OnClose()
+}
 
-			agent.OnClose()
+// handshake reads the session hello of conn, it either resumes a known session
+// on conn or registers a new one.
+func (s *TcpServer) handshake(conn net.Conn) (*tcpSession, bool) {
+	codec := newFrameCodec(s.pCreateParam)
+	hello, err := readHandshake(conn, &codec, sessHello, sessHelloLength)
+	if nil != err {
+		logger.Error("session handshake from %v error: %v", conn.RemoteAddr(), err)
+		return nil, false
+	}
+
+	var token sessionToken
+	copy(token[:], hello[1:])
+	peerRecv := binary.BigEndian.Uint64(hello[1+sessTokenLength:])
+
+	if token != (sessionToken{}) {
+		s.connMutex.Lock()
+		session := s.sessionSet[token]
+		s.connMutex.Unlock()
+
+		if nil != session {
+			welcome, err := packWelcome(&codec, token, session.recvSeq(), true)
+			if nil == err && session.attach(conn, peerRecv, welcome) {
+				return session, true
+			}
+		}
+
+		logger.Warn("session resume from %v rejected", conn.RemoteAddr())
+		if reject, err := packWelcome(&codec, sessionToken{}, 0, false); nil == err {
+			conn.Write(reject)
+		}
+		return nil, false
+	}
+
+	if token, err = newSessionToken(); nil != err {
+		logger.Error("new session token error: %v", err)
+		return nil, false
+	}
+	welcome, err := packWelcome(&codec, token, 0, false)
+	if nil != err {
+		return nil, false
+	}
+	if _, err := conn.Write(welcome); nil != err {
+		return nil, false
+	}
+
+	session := newTcpSession(token, s.pSessionParam, conn)
+	session.onLost = func() {
+		s.connMutex.Lock()
+		s.removeLink(session)
+		s.connMutex.Unlock()
+	}
+	s.connMutex.Lock()
+	if nil == s.sessionSet {
+		s.connMutex.Unlock()
+		return nil, false
+	}
+	s.sessionSet[token] = session
+	s.connMutex.Unlock()
+
+	return session, false
+}
 
-			s.connWait.Done()
-		}()
+// Shutdown stops accepting and waits for the existing connections to end,
+// the remaining ones are closed when ctx ends first.
+func (s *TcpServer) Shutdown(ctx context.Context) error {
+	s.closeListeners()
+
+	if waitContext(ctx, &s.connWait) {
+		return nil
 	}
+	s.Close()
+	return ctx.Err()
 }
 
-func (s *TcpServer) Close() {
-	s.ln.Close()
+func (s *TcpServer) closeListeners() {
+	s.connMutex.Lock()
+	s.bClosed = true
+	lnList := s.lnList
+	s.lnList = nil
+	s.connMutex.Unlock()
+
+	closeServerListeners(lnList)
 	s.lnWait.Wait()
+}
+
+func (s *TcpServer) Close() {
+	s.closeListeners()
 
 	s.connMutex.Lock()
+	for _, session := range s.sessionSet {
+		session.expire()
+	}
+	s.sessionSet = nil
+	s.linkSet = nil
 	for conn := range s.connSet {
 		conn.Close()
 	}
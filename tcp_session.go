@@ -0,0 +1,525 @@
+package go_net
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hezhis/go_log"
+)
+
+// Resumable session protocol. Every frame of a session connection starts with
+// a type byte inside the usual length prefix:
+//
+//	hello   client -> server  token[16] recvSeq[8]            zero token asks for a new session
+//	welcome server -> client  token[16] recvSeq[8] resumed[1]  zero token rejects the resume
+//	data    seq[8] ack[8] payload
+//	ack     ack[8]
+//	bye     the peer closed the session on purpose
+//
+// Sequence numbers are big endian and start from 1. Unacknowledged data frames
+// stay in a bounded replay buffer and are sent again after a resume.
+const (
+	sessHello byte = iota + 1
+	sessWelcome
+	sessData
+	sessAck
+	sessBye
+)
+
+const (
+	sessTokenLength      = 16
+	sessDataHeadLength   = 17
+	sessAckLength        = 9
+	sessHelloLength      = 1 + sessTokenLength + 8
+	sessWelcomeLength    = sessHelloLength + 1
+	sessHandshakeTimeout = 10 * time.Second
+)
+
+var (
+	ErrSessionExpired    = errors.New("session expired")
+	ErrReplayBufferFull  = errors.New("session replay buffer full")
+	errSessionHandshake  = errors.New("invalid session handshake")
+	errSessionFrame      = errors.New("invalid session frame")
+	errSessionOutOfOrder = errors.New("session frame out of order")
+)
+
+type (
+	SessionParam struct {
+		nGrace     time.Duration
+		nReplayCap int
+	}
+
+	sessionToken [sessTokenLength]byte
+
+	replayFrame struct {
+		nSeq uint64
+		data []byte
+	}
+
+	tcpSession struct {
+		token  sessionToken
+		pParam *SessionParam
+
+		locker   sync.Mutex
+		cond     *sync.Cond
+		conn     net.Conn // nil while suspended
+		lastConn net.Conn
+		nGen     uint64
+		bExpired bool
+		tGrace   *time.Timer
+
+		sendLocker sync.Mutex
+		nSendSeq   uint64
+		nPeerAck   uint64
+		replay     []replayFrame
+
+		nRecvSeq   uint64
+		nAckedSeq  uint64
+		nAckEvery  uint64
+		pConnector *TcpConnector
+
+		onLost    func()
+		onExpired func()
+	}
+
+	sessionWriter struct {
+		nGen     uint64
+		nLastSeq uint64
+	}
+)
+
+func newTcpSession(token sessionToken, param *SessionParam, conn net.Conn) *tcpSession {
+	s := &tcpSession{
+		token:    token,
+		pParam:   param,
+		conn:     conn,
+		lastConn: conn,
+		nGen:     1,
+	}
+	s.cond = sync.NewCond(&s.locker)
+	s.nAckEvery = uint64(param.nReplayCap / 4)
+	if s.nAckEvery == 0 {
+		s.nAckEvery = 1
+	}
+	return s
+}
+
+func newSessionToken() (sessionToken, error) {
+	var token sessionToken
+	_, err := rand.Read(token[:])
+	return token, err
+}
+
+func (s *tcpSession) link() (net.Conn, uint64) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	for nil == s.conn && !s.bExpired {
+		s.cond.Wait()
+	}
+	if s.bExpired {
+		return nil, 0
+	}
+	return s.conn, s.nGen
+}
+
+func (s *tcpSession) lastLink() net.Conn {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	return s.lastConn
+}
+
+func (s *tcpSession) expired() bool {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	return s.bExpired
+}
+
+// linkLost suspends the session if conn is still its current link and starts the grace period.
+func (s *tcpSession) linkLost(conn net.Conn) {
+	s.locker.Lock()
+	if s.conn != conn || s.bExpired {
+		s.locker.Unlock()
+		return
+	}
+	conn.Close()
+	s.conn = nil
+	s.tGrace = time.AfterFunc(s.pParam.nGrace, s.expire)
+	onLost := s.onLost
+	s.locker.Unlock()
+
+	logger.Warn("session link %v lost, wait %v for resume", conn.RemoteAddr(), s.pParam.nGrace)
+	if nil != onLost {
+		onLost()
+	}
+}
+
+// attach resumes the session on conn, welcome is sent on conn before the link is switched.
+func (s *tcpSession) attach(conn net.Conn, peerRecv uint64, welcome []byte) bool {
+	s.locker.Lock()
+	if s.bExpired {
+		s.locker.Unlock()
+		return false
+	}
+	if nil != welcome {
+		conn.SetWriteDeadline(time.Now().Add(sessHandshakeTimeout))
+		_, err := conn.Write(welcome)
+		conn.SetWriteDeadline(time.Time{})
+		if nil != err {
+			s.locker.Unlock()
+			return false
+		}
+	}
+	if nil != s.conn {
+		s.conn.Close()
+	}
+	if nil != s.tGrace {
+		s.tGrace.Stop()
+		s.tGrace = nil
+	}
+	s.conn = conn
+	s.lastConn = conn
+	s.nGen++
+	s.cond.Broadcast()
+	connector := s.pConnector
+	s.locker.Unlock()
+
+	s.acked(peerRecv)
+	logger.Info("session resumed on %v", conn.RemoteAddr())
+
+	// wake the writer up to send the unacknowledged frames
+	if nil != connector {
+		connector.Write([]byte{})
+	}
+	return true
+}
+
+func (s *tcpSession) expire() {
+	s.locker.Lock()
+	if s.bExpired {
+		s.locker.Unlock()
+		return
+	}
+	s.bExpired = true
+	if nil != s.conn {
+		s.conn.Close()
+		s.conn = nil
+	}
+	if nil != s.tGrace {
+		s.tGrace.Stop()
+		s.tGrace = nil
+	}
+	s.cond.Broadcast()
+	onExpired := s.onExpired
+	s.locker.Unlock()
+
+	if nil != onExpired {
+		onExpired()
+	}
+}
+
+// notifyExpired sets f to be called once the session expires, it reports false
+// if the session is already expired.
+func (s *tcpSession) notifyExpired(f func()) bool {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	s.onExpired = f
+	return !s.bExpired
+}
+
+func (s *tcpSession) acked(ack uint64) {
+	s.sendLocker.Lock()
+	defer s.sendLocker.Unlock()
+
+	if ack <= s.nPeerAck {
+		return
+	}
+	s.nPeerAck = ack
+
+	n := 0
+	for n < len(s.replay) && s.replay[n].nSeq <= ack {
+		n++
+	}
+	s.replay = append(s.replay[:0], s.replay[n:]...)
+}
+
+func (s *tcpSession) unacked() ([]replayFrame, uint64) {
+	s.sendLocker.Lock()
+	defer s.sendLocker.Unlock()
+
+	frames := make([]replayFrame, len(s.replay))
+	copy(frames, s.replay)
+	return frames, s.nPeerAck
+}
+
+func (s *tcpSession) recvSeq() uint64 {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	return s.nRecvSeq
+}
+
+func (s *tcpSession) writeMsg(c *TcpConnector, args ...[]byte) error {
+	s.sendLocker.Lock()
+	defer s.sendLocker.Unlock()
+
+	if len(s.replay) >= s.pParam.nReplayCap {
+		return ErrReplayBufferFull
+	}
+
+	header := make([]byte, sessDataHeadLength)
+	header[0] = sessData
+	binary.BigEndian.PutUint64(header[1:], s.nSendSeq+1)
+	binary.BigEndian.PutUint64(header[9:], s.ackSeq())
+
+	msg, err := c.pack(append([][]byte{header}, args...)...)
+	if nil != err {
+		return err
+	}
+
+	s.nSendSeq++
+	s.replay = append(s.replay, replayFrame{nSeq: s.nSendSeq, data: msg})
+
+	// frames written while suspended are sent by the writer after resume
+	s.locker.Lock()
+	suspended := nil == s.conn
+	s.locker.Unlock()
+	if !suspended {
+		c.Write(msg)
+	}
+	return nil
+}
+
+// ackSeq returns the receive sequence and records that it's acknowledged.
+func (s *tcpSession) ackSeq() uint64 {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	s.nAckedSeq = s.nRecvSeq
+	return s.nRecvSeq
+}
+
+// received records an inbound data frame, returning false for duplicates.
+func (s *tcpSession) received(seq uint64) (bool, bool, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if seq <= s.nRecvSeq {
+		return false, false, nil
+	}
+	if seq != s.nRecvSeq+1 {
+		return false, false, errSessionOutOfOrder
+	}
+	s.nRecvSeq = seq
+	return true, s.nRecvSeq-s.nAckedSeq >= s.nAckEvery, nil
+}
+
+func (s *tcpSession) readMsg(c *TcpConnector) ([]byte, error) {
+	for {
+		conn, _ := s.link()
+		if nil == conn {
+			return nil, ErrSessionExpired
+		}
+
+		data, err := c.read(conn, c.bHeader)
+		if nil != err {
+			if s.expired() {
+				return nil, err
+			}
+			s.linkLost(conn)
+			continue
+		}
+		if len(data) == 0 {
+			return nil, errSessionFrame
+		}
+
+		switch data[0] {
+		case sessData:
+			if len(data) < sessDataHeadLength {
+				return nil, errSessionFrame
+			}
+			s.acked(binary.BigEndian.Uint64(data[9:]))
+			fresh, needAck, err := s.received(binary.BigEndian.Uint64(data[1:]))
+			if nil != err {
+				return nil, err
+			}
+			if needAck {
+				s.sendAck(c)
+			}
+			if fresh {
+				return data[sessDataHeadLength:], nil
+			}
+		case sessAck:
+			if len(data) < sessAckLength {
+				return nil, errSessionFrame
+			}
+			s.acked(binary.BigEndian.Uint64(data[1:]))
+		case sessBye:
+			s.expire()
+			return nil, io.EOF
+		default:
+			return nil, errSessionFrame
+		}
+	}
+}
+
+func (s *tcpSession) sendAck(c *TcpConnector) {
+	frame := make([]byte, sessAckLength)
+	frame[0] = sessAck
+	binary.BigEndian.PutUint64(frame[1:], s.ackSeq())
+	if msg, err := c.pack(frame); nil == err {
+		c.Write(msg)
+	}
+}
+
+// write sends b on the current link, after a resume the unacknowledged frames
+// are sent first and frames already covered by them are skipped.
+func (s *tcpSession) write(c *TcpConnector, w *sessionWriter, b []byte) bool {
+	for {
+		conn, gen := s.link()
+		if nil == conn {
+			return false
+		}
+
+		if gen != w.nGen {
+			frames, peerAck := s.unacked()
+			if peerAck > w.nLastSeq {
+				w.nLastSeq = peerAck
+			}
+
+			var err error
+			for _, frame := range frames {
+				if _, err = conn.Write(frame.data); nil != err {
+					break
+				}
+				w.nLastSeq = frame.nSeq
+			}
+			if nil != err {
+				s.linkLost(conn)
+				continue
+			}
+			w.nGen = gen
+		}
+
+		// the empty frame only asks for the resend above
+		if len(b) == 0 {
+			return true
+		}
+
+		seq, isData := sessionFrameSeq(c.nHeadLength, b)
+		if isData && seq <= w.nLastSeq {
+			return true
+		}
+		if _, err := conn.Write(b); nil != err {
+			s.linkLost(conn)
+			continue
+		}
+		if isData {
+			w.nLastSeq = seq
+		}
+		return true
+	}
+}
+
+func sessionFrameSeq(headLength int, b []byte) (uint64, bool) {
+	if len(b) < headLength+sessDataHeadLength || b[headLength] != sessData {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(b[headLength+1:]), true
+}
+
+func (s *tcpSession) runWriter(c *TcpConnector) {
+	w := &sessionWriter{nGen: 1}
+	for b := range c.cWriteBuffChan {
+		if b == nil {
+			break
+		}
+		if !s.write(c, w, b) {
+			break
+		}
+		notifyDrained(c.cDrained)
+	}
+
+	s.locker.Lock()
+	conn := s.conn
+	s.locker.Unlock()
+	if nil != conn {
+		if bye, err := c.pack([]byte{sessBye}); nil == err {
+			conn.Write(bye)
+		}
+	}
+	s.expire()
+}
+
+func packHello(codec *frameCodec, token sessionToken, recv uint64) ([]byte, error) {
+	payload := make([]byte, sessHelloLength)
+	payload[0] = sessHello
+	copy(payload[1:], token[:])
+	binary.BigEndian.PutUint64(payload[1+sessTokenLength:], recv)
+	return codec.pack(payload)
+}
+
+func packWelcome(codec *frameCodec, token sessionToken, recv uint64, resumed bool) ([]byte, error) {
+	payload := make([]byte, sessWelcomeLength)
+	payload[0] = sessWelcome
+	copy(payload[1:], token[:])
+	binary.BigEndian.PutUint64(payload[1+sessTokenLength:], recv)
+	if resumed {
+		payload[sessHelloLength] = 1
+	}
+	return codec.pack(payload)
+}
+
+func readHandshake(conn net.Conn, codec *frameCodec, kind byte, length int) ([]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(sessHandshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	data, err := codec.read(conn, make([]byte, codec.nHeadLength))
+	if nil != err {
+		return nil, err
+	}
+	if len(data) != length || data[0] != kind {
+		return nil, errSessionHandshake
+	}
+	return data, nil
+}
+
+// clientHandshake asks the server for a new session (zero token) or to resume one.
+func clientHandshake(conn net.Conn, codec *frameCodec, token sessionToken, recv uint64) (sessionToken, uint64, bool, error) {
+	hello, err := packHello(codec, token, recv)
+	if nil != err {
+		return token, 0, false, err
+	}
+	conn.SetWriteDeadline(time.Now().Add(sessHandshakeTimeout))
+	_, err = conn.Write(hello)
+	conn.SetWriteDeadline(time.Time{})
+	if nil != err {
+		return token, 0, false, err
+	}
+
+	data, err := readHandshake(conn, codec, sessWelcome, sessWelcomeLength)
+	if nil != err {
+		return token, 0, false, err
+	}
+
+	var newToken sessionToken
+	copy(newToken[:], data[1:])
+	peerRecv := binary.BigEndian.Uint64(data[1+sessTokenLength:])
+	resumed := data[sessHelloLength] == 1
+	if newToken == (sessionToken{}) {
+		if token == (sessionToken{}) {
+			return newToken, 0, false, errSessionHandshake
+		}
+		// the server doesn't know the session anymore
+		return newToken, 0, false, nil
+	}
+	return newToken, peerRecv, resumed, nil
+}
@@ -0,0 +1,208 @@
+package go_net
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordAgent struct {
+	pConn *TcpConnector
+	cRecv chan string
+}
+
+func (a *recordAgent) LogicRun() {
+	for {
+		msg, err := a.pConn.ReadMsg()
+		if nil != err {
+			return
+		}
+		a.cRecv <- string(msg)
+	}
+}
+
+func (a *recordAgent) OnClose() {}
+
+// freeAddr returns a local tcp address nothing listens on.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// linkProxy forwards connections to a server, drop cuts the current ones.
+type linkProxy struct {
+	ln     net.Listener
+	locker sync.Mutex
+	conns  []net.Conn
+}
+
+func newLinkProxy(t *testing.T, target string) *linkProxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	p := &linkProxy{ln: ln}
+	t.Cleanup(func() {
+		ln.Close()
+		p.drop()
+	})
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if nil != err {
+				return
+			}
+			upstream, err := net.Dial("tcp", target)
+			if nil != err {
+				conn.Close()
+				continue
+			}
+			p.locker.Lock()
+			p.conns = append(p.conns, conn, upstream)
+			p.locker.Unlock()
+			go io.Copy(upstream, conn)
+			go io.Copy(conn, upstream)
+		}
+	}()
+	return p
+}
+
+func (p *linkProxy) drop() {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+func expectMsg(t *testing.T, ch chan string, want string) {
+	t.Helper()
+	select {
+	case got := <-ch:
+		if got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %q", want)
+	}
+}
+
+func TestSessionResumeReplaysAndTrims(t *testing.T) {
+	addr := freeAddr(t)
+	serverRecv := make(chan string, 1024)
+	serverConns := make(chan *TcpConnector, 4)
+	server := NewTcpServer(TcpSLocalAddr(addr), TcpSHeadLen(2), TcpSSession(5*time.Second, 1024))
+	server.NewAgent = func(c *TcpConnector) Agent {
+		serverConns <- c
+		return &recordAgent{pConn: c, cRecv: serverRecv}
+	}
+	server.Start()
+	defer server.Close()
+
+	proxy := newLinkProxy(t, addr)
+	clientRecv := make(chan string, 16)
+	clientConns := make(chan *TcpConnector, 4)
+	client := NewTcpClient(TcpCRemoteAddr(proxy.ln.Addr().String()), TcpCReadHeadLen(2),
+		TcpCSession(5*time.Second, 1024), TcpCConnectInterval(10*time.Millisecond))
+	client.NewAgent = func(c *TcpConnector) Agent {
+		clientConns <- c
+		return &recordAgent{pConn: c, cRecv: clientRecv}
+	}
+	client.Start()
+	defer client.Close()
+	c := <-clientConns
+
+	// frames in flight when the link drops are replayed after the resume
+	for i := 1; i <= 200; i++ {
+		if i == 100 {
+			proxy.drop()
+		}
+		if err := c.WriteMsg([]byte(strconv.Itoa(i))); nil != err {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i <= 200; i++ {
+		expectMsg(t, serverRecv, strconv.Itoa(i))
+	}
+
+	// the reply acknowledges everything the server received
+	sc := <-serverConns
+	if err := sc.WriteMsg([]byte("done")); nil != err {
+		t.Fatal(err)
+	}
+	expectMsg(t, clientRecv, "done")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if frames, _ := c.pSession.unacked(); len(frames) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("acknowledged frames stay in the replay buffer")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case <-clientConns:
+		t.Fatal("the resume created a new client connection")
+	case <-serverConns:
+		t.Fatal("the resume created a new server connection")
+	default:
+	}
+}
+
+func sessionPipe(t *testing.T, param *SessionParam) (*TcpConnector, *tcpSession, net.Conn) {
+	a, b := net.Pipe()
+	session := newTcpSession(sessionToken{1}, param, a)
+	c := newTcpConnector(a, &CreateConnectorParam{nHeadLength: 2, nMaxMsgLength: 64, nWriteBuffCap: 16}, session)
+	t.Cleanup(func() {
+		c.Destroy()
+		b.Close()
+	})
+	return c, session, b
+}
+
+func TestSessionReplayBufferFull(t *testing.T) {
+	// nothing reads the peer end, so no frame gets acknowledged
+	c, _, _ := sessionPipe(t, &SessionParam{nGrace: time.Second, nReplayCap: 2})
+
+	for i := 0; i < 2; i++ {
+		if err := c.WriteMsg([]byte("x")); nil != err {
+			t.Fatal(err)
+		}
+	}
+	if err := c.WriteMsg([]byte("x")); err != ErrReplayBufferFull {
+		t.Fatalf("got %v, want ErrReplayBufferFull", err)
+	}
+}
+
+func TestSessionGraceExpiry(t *testing.T) {
+	grace := 50 * time.Millisecond
+	c, session, peer := sessionPipe(t, &SessionParam{nGrace: grace, nReplayCap: 4})
+
+	lost := time.Now()
+	peer.Close()
+	if _, err := c.ReadMsg(); err != ErrSessionExpired {
+		t.Fatalf("got %v, want ErrSessionExpired", err)
+	}
+	if elapsed := time.Since(lost); elapsed < grace {
+		t.Fatalf("expired after %v, grace is %v", elapsed, grace)
+	}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if session.attach(a, 0, nil) {
+		t.Fatal("an expired session got resumed")
+	}
+}
@@ -0,0 +1,319 @@
+package go_net
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/hezhis/go_log"
+)
+
+// streamChunkSize bounds the frames a stream is cut into.
+const streamChunkSize = 64 << 10
+
+// the first byte of a tcp stream frame
+const (
+	streamBegin byte = iota + 1
+	streamChunk
+	streamEnd
+	streamAbort // the rest of the frame is the reason
+)
+
+var (
+	ErrStreamClosed   = errors.New("stream closed")
+	ErrStreamTooLong  = errors.New("stream too long")
+	ErrStreamPending  = errors.New("too many messages wait for a stream to end")
+	ErrStreamAborted  = errors.New("stream aborted")
+	ErrStreamFrame    = errors.New("not a stream frame")
+	ErrStreamEmptyMsg = errors.New("empty message written while a stream is open")
+)
+
+type (
+	// tcpStreamReader reads a streamed message, a begin frame followed by
+	// chunks and ended by an end or abort frame. Messages written while the
+	// stream is open follow it, so the frames of a stream are never mixed
+	// with other messages.
+	tcpStreamReader struct {
+		pConn *TcpConnector
+		buff  []byte
+		nRead int64
+		err   error
+	}
+
+	// tcpStreamWriter cuts the written data into frames of at most
+	// streamChunkSize bytes, Close sends the frame ending the stream.
+	tcpStreamWriter struct {
+		pConn    *TcpConnector
+		buff     []byte
+		bStarted bool
+		err      error
+	}
+)
+
+// ReadStream returns the next message as a stream, the peer sends it with
+// WriteStream. It fails with ErrStreamFrame when the next message doesn't
+// begin a stream, the reader fails with ErrStreamAborted when the peer
+// aborted the stream.
+func (c *TcpConnector) ReadStream() (io.Reader, error) {
+	r := &tcpStreamReader{pConn: c}
+	kind, err := r.next()
+	if nil != err {
+		return nil, err
+	}
+	if kind != streamBegin {
+		return nil, ErrStreamFrame
+	}
+	return r, nil
+}
+
+// WriteStream returns a writer sending one message as a stream, memory stays
+// bounded as the writer waits for the write queue to drain.
+func (c *TcpConnector) WriteStream() StreamWriter {
+	// a frame starts with its kind
+	size := int(c.nMaxMsgLength) - 1
+	if nil != c.pSession {
+		size -= sessDataHeadLength
+	}
+	if size > streamChunkSize {
+		size = streamChunkSize
+	}
+	w := &tcpStreamWriter{pConn: c}
+	if size <= 0 {
+		w.err = errors.New("message length too small to stream")
+	} else {
+		w.buff = make([]byte, 0, size)
+	}
+	return w
+}
+
+func (r *tcpStreamReader) Read(p []byte) (int, error) {
+	for len(r.buff) == 0 {
+		if nil != r.err {
+			return 0, r.err
+		}
+		kind, err := r.next()
+		if nil != err {
+			return 0, err
+		}
+		if kind == streamBegin {
+			r.buff = nil
+			r.err = ErrStreamFrame
+		}
+	}
+
+	n := copy(p, r.buff)
+	r.buff = r.buff[n:]
+	return n, nil
+}
+
+// next reads the next frame of the stream, err is kept for the following
+// reads and io.EOF once the end frame got read.
+func (r *tcpStreamReader) next() (byte, error) {
+	msg, err := r.pConn.ReadMsg()
+	if nil != err {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		r.err = err
+		return 0, err
+	}
+	if len(msg) == 0 {
+		r.err = ErrStreamFrame
+		return 0, r.err
+	}
+
+	kind, data := msg[0], msg[1:]
+	switch kind {
+	case streamBegin, streamChunk:
+	case streamEnd:
+		r.err = io.EOF
+	case streamAbort:
+		r.err = fmt.Errorf("%w: %s", ErrStreamAborted, data)
+		return kind, r.err
+	default:
+		r.err = ErrStreamFrame
+		return kind, r.err
+	}
+
+	r.nRead += int64(len(data))
+	if max := r.pConn.nMaxStreamLength; max > 0 && r.nRead > max {
+		r.err = ErrStreamTooLong
+		return kind, r.err
+	}
+	r.buff = data
+	return kind, nil
+}
+
+func (w *tcpStreamWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if nil != w.err {
+			return written, w.err
+		}
+
+		n := copy(w.buff[len(w.buff):cap(w.buff)], p)
+		w.buff = w.buff[:len(w.buff)+n]
+		p = p[n:]
+		written += n
+
+		if len(w.buff) == cap(w.buff) {
+			w.flush()
+		}
+	}
+	return written, w.err
+}
+
+// flush writes the buffered data as the next frame, the first one begins the
+// stream.
+func (w *tcpStreamWriter) flush() {
+	kind := streamChunk
+	if !w.bStarted {
+		kind = streamBegin
+	}
+	if err := w.writeFrame(kind, w.buff); nil != err {
+		w.fail(err)
+		return
+	}
+	w.buff = w.buff[:0]
+}
+
+func (w *tcpStreamWriter) writeFrame(kind byte, data []byte) error {
+	c := w.pConn
+	if err := c.waitRoom(); nil != err {
+		return err
+	}
+
+	c.streamLocker.Lock()
+	defer c.streamLocker.Unlock()
+
+	if err := c.writeMsg([]byte{kind}, data); nil != err {
+		return err
+	}
+	w.bStarted = true
+	c.bStreaming = true
+	return nil
+}
+
+// finish writes the frame ending the stream and the messages held back by
+// it.
+func (w *tcpStreamWriter) finish(kind byte, data []byte) error {
+	c := w.pConn
+	if err := c.waitRoom(); nil != err {
+		w.fail(err)
+		return err
+	}
+
+	c.streamLocker.Lock()
+	defer c.streamLocker.Unlock()
+
+	if err := c.writeMsg([]byte{kind}, data); nil != err {
+		w.err = err
+		c.dropHeld(err)
+		return err
+	}
+	w.err = ErrStreamClosed
+	return c.endStream()
+}
+
+// fail ends a stream that can't be written any more, the messages held back
+// by it are dropped.
+func (w *tcpStreamWriter) fail(err error) {
+	w.err = err
+	c := w.pConn
+	c.streamLocker.Lock()
+	defer c.streamLocker.Unlock()
+
+	c.dropHeld(err)
+}
+
+// Close writes the rest and ends the stream.
+func (w *tcpStreamWriter) Close() error {
+	if nil != w.err {
+		return w.err
+	}
+	if !w.bStarted {
+		if err := w.writeFrame(streamBegin, w.buff); nil != err {
+			w.fail(err)
+			return err
+		}
+		w.buff = w.buff[:0]
+	}
+	return w.finish(streamEnd, w.buff)
+}
+
+// CloseWithError aborts the stream, the reader of the peer fails with
+// ErrStreamAborted and the text of err. Nothing is sent when no frame was
+// written yet.
+func (w *tcpStreamWriter) CloseWithError(err error) error {
+	if nil != w.err {
+		return w.err
+	}
+	if nil == err {
+		err = ErrStreamAborted
+	}
+	if !w.bStarted {
+		w.err = ErrStreamClosed
+		w.buff = nil
+		return nil
+	}
+
+	reason := []byte(err.Error())
+	if len(reason) > cap(w.buff) {
+		reason = reason[:cap(w.buff)]
+	}
+	w.buff = nil
+	return w.finish(streamAbort, reason)
+}
+
+// hold keeps a message written while a stream is open until the stream ends,
+// it must be called with streamLocker held.
+func (c *TcpConnector) hold(args ...[]byte) error {
+	if len(c.held) >= cap(c.cWriteBuffChan) {
+		return ErrStreamPending
+	}
+
+	var size int
+	for _, arg := range args {
+		size += len(arg)
+	}
+	if 0 == size {
+		return ErrStreamEmptyMsg
+	}
+	if uint32(size) > c.nMaxMsgLength {
+		return errors.New("message too long")
+	}
+
+	msg := make([]byte, 0, size)
+	for _, arg := range args {
+		msg = append(msg, arg...)
+	}
+	c.held = append(c.held, msg)
+	return nil
+}
+
+// endStream writes the messages held back by the stream, it must be called
+// with streamLocker held.
+func (c *TcpConnector) endStream() error {
+	held := c.held
+	c.held = nil
+	c.bStreaming = false
+
+	for _, msg := range held {
+		if err := c.waitRoom(); nil != err {
+			return err
+		}
+		if err := c.writeMsg(msg); nil != err {
+			logger.Error("write held message error: %v", err)
+		}
+	}
+	return nil
+}
+
+// dropHeld ends a failed stream, it must be called with streamLocker held.
+func (c *TcpConnector) dropHeld(err error) {
+	if len(c.held) > 0 {
+		logger.Error("drop %v messages held back by a failed stream: %v", len(c.held), err)
+	}
+	c.held = nil
+	c.bStreaming = false
+}
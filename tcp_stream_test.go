@@ -0,0 +1,135 @@
+package go_net
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tcpPipe(t *testing.T) (*TcpConnector, *TcpConnector) {
+	param := &CreateConnectorParam{nMaxMsgLength: 64, nWriteBuffCap: 16}
+	a, b := net.Pipe()
+	ca, cb := newTcpConnector(a, param, nil), newTcpConnector(b, param, nil)
+	t.Cleanup(func() {
+		ca.Destroy()
+		cb.Destroy()
+	})
+	return ca, cb
+}
+
+func TestTcpStreamHoldsMessages(t *testing.T) {
+	w, r := tcpPipe(t)
+	data := bytes.Repeat([]byte("0123456789"), 100)
+
+	errCh := make(chan error, 1)
+	go func() {
+		s := w.WriteStream()
+		if _, err := s.Write(data[:500]); nil != err {
+			errCh <- err
+			return
+		}
+		if err := w.WriteMsg(); err != ErrStreamEmptyMsg {
+			errCh <- err
+			return
+		}
+		if err := w.WriteMsg([]byte("after")); nil != err {
+			errCh <- err
+			return
+		}
+		if _, err := s.Write(data[500:]); nil != err {
+			errCh <- err
+			return
+		}
+		errCh <- s.Close()
+	}()
+
+	stream, err := r.ReadStream()
+	if nil != err {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(stream)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("read %v bytes, want %v", len(got), len(data))
+	}
+	if err := <-errCh; nil != err {
+		t.Fatal(err)
+	}
+
+	msg, err := r.ReadMsg()
+	if nil != err || string(msg) != "after" {
+		t.Fatalf("got %q, %v after the stream", msg, err)
+	}
+}
+
+func TestTcpStreamAbort(t *testing.T) {
+	w, r := tcpPipe(t)
+
+	go func() {
+		s := w.WriteStream()
+		s.Write(bytes.Repeat([]byte("x"), 100))
+		w.WriteMsg([]byte("after"))
+		s.CloseWithError(errors.New("source gone"))
+	}()
+
+	stream, err := r.ReadStream()
+	if nil != err {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(stream)
+	if !errors.Is(err, ErrStreamAborted) || !strings.Contains(err.Error(), "source gone") {
+		t.Fatalf("got %v, want the abort", err)
+	}
+
+	msg, err := r.ReadMsg()
+	if nil != err || string(msg) != "after" {
+		t.Fatalf("got %q, %v after the aborted stream", msg, err)
+	}
+}
+
+func TestTcpStreamFailureEndsStream(t *testing.T) {
+	w, r := tcpPipe(t)
+
+	s := w.WriteStream()
+	go func() {
+		// takes the first frame, then the connection goes away
+		r.ReadMsg()
+		r.Destroy()
+	}()
+
+	chunk := bytes.Repeat([]byte("x"), 100)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := s.Write(chunk); nil != err {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stream writes kept succeeding on a closed connection")
+		}
+	}
+	if nil == s.Close() {
+		t.Fatal("Close succeeded after a failed write")
+	}
+
+	w.streamLocker.Lock()
+	streaming, held := w.bStreaming, len(w.held)
+	w.streamLocker.Unlock()
+	if streaming || held > 0 {
+		t.Fatalf("stream still open after failing, %v held messages", held)
+	}
+}
+
+func TestTcpReadStreamRejectsMessage(t *testing.T) {
+	w, r := tcpPipe(t)
+
+	go w.WriteMsg([]byte("plain"))
+	if _, err := r.ReadStream(); err != ErrStreamFrame {
+		t.Fatalf("got %v, want ErrStreamFrame", err)
+	}
+}
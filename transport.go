@@ -0,0 +1,307 @@
+package go_net
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// ListenFunc creates the server of a listen url.
+	ListenFunc func(u *url.URL) (Server, error)
+	// DialFunc creates the client of a dial url.
+	DialFunc func(u *url.URL) (Client, error)
+
+	transport struct {
+		listen ListenFunc
+		dial   DialFunc
+	}
+
+	// urlQuery takes the options out of the query of a url, the first
+	// malformed value is kept in err.
+	urlQuery struct {
+		values url.Values
+		err    error
+	}
+)
+
+var (
+	transportLocker sync.RWMutex
+	transports      = make(map[string]transport)
+)
+
+func init() {
+	RegisterTransport("tcp", listenTcpURL, dialTcpURL)
+	RegisterTransport("unix", listenTcpURL, dialTcpURL)
+	RegisterTransport("ws", listenWSURL, dialWSURL)
+	RegisterTransport("wss", listenWSURL, dialWSURL)
+}
+
+// RegisterTransport makes Listen and Dial create servers and clients for urls
+// of scheme, either func may be nil. A registered scheme is replaced.
+func RegisterTransport(scheme string, listen ListenFunc, dial DialFunc) {
+	transportLocker.Lock()
+	defer transportLocker.Unlock()
+
+	transports[strings.ToLower(scheme)] = transport{listen: listen, dial: dial}
+}
+
+func lookupTransport(rawURL string) (*url.URL, transport, error) {
+	u, err := url.Parse(rawURL)
+	if nil != err {
+		return nil, transport{}, err
+	}
+
+	transportLocker.RLock()
+	t, ok := transports[u.Scheme]
+	transportLocker.RUnlock()
+	if !ok {
+		return nil, transport{}, fmt.Errorf("unknown transport %q", u.Scheme)
+	}
+	return u, t, nil
+}
+
+// Listen creates the server described by rawURL, e.g.
+// tcp://0.0.0.0:6321?head=4&le=1, ws://:8080/path or unix:///run/x.sock.
+// The server still needs SetNewAgent and Start.
+func Listen(rawURL string) (Server, error) {
+	u, t, err := lookupTransport(rawURL)
+	if nil != err {
+		return nil, err
+	}
+	if nil == t.listen {
+		return nil, fmt.Errorf("transport %q can not listen", u.Scheme)
+	}
+	return t.listen(u)
+}
+
+// Dial creates the client described by rawURL, the client still needs
+// SetNewAgent and Start.
+func Dial(rawURL string) (Client, error) {
+	u, t, err := lookupTransport(rawURL)
+	if nil != err {
+		return nil, err
+	}
+	if nil == t.dial {
+		return nil, fmt.Errorf("transport %q can not dial", u.Scheme)
+	}
+	return t.dial(u)
+}
+
+func newURLQuery(u *url.URL) *urlQuery {
+	return &urlQuery{values: u.Query()}
+}
+
+func (q *urlQuery) take(key string) (string, bool) {
+	if _, ok := q.values[key]; !ok {
+		return "", false
+	}
+	value := q.values.Get(key)
+	q.values.Del(key)
+	return value, true
+}
+
+func (q *urlQuery) fail(key, value string, err error) {
+	if nil == q.err {
+		q.err = fmt.Errorf("invalid %v=%v: %v", key, value, err)
+	}
+}
+
+func (q *urlQuery) int(key string, apply func(int)) {
+	if value, ok := q.take(key); ok {
+		if n, err := strconv.Atoi(value); nil != err {
+			q.fail(key, value, err)
+		} else {
+			apply(n)
+		}
+	}
+}
+
+func (q *urlQuery) bool(key string, apply func(bool)) {
+	if value, ok := q.take(key); ok {
+		if value == "" {
+			apply(true)
+		} else if b, err := strconv.ParseBool(value); nil != err {
+			q.fail(key, value, err)
+		} else {
+			apply(b)
+		}
+	}
+}
+
+func (q *urlQuery) duration(key string, apply func(time.Duration)) {
+	if value, ok := q.take(key); ok {
+		if d, err := time.ParseDuration(value); nil != err {
+			q.fail(key, value, err)
+		} else {
+			apply(d)
+		}
+	}
+}
+
+func (q *urlQuery) string(key string, apply func(string)) {
+	if value, ok := q.take(key); ok {
+		apply(value)
+	}
+}
+
+// done reports the first malformed value, or the keys nobody took when
+// strict is set.
+func (q *urlQuery) done(strict bool) error {
+	if nil != q.err || !strict || len(q.values) == 0 {
+		return q.err
+	}
+
+	keys := make([]string, 0, len(q.values))
+	for key := range q.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return fmt.Errorf("unknown options %v", strings.Join(keys, ","))
+}
+
+func tcpURLAddr(u *url.URL) string {
+	if u.Scheme == "unix" {
+		return u.Path
+	}
+	return u.Host
+}
+
+// listenTcpURL takes head, le, maxmsg, maxclients, writebuff, reuseport,
+// systemd, session and replay from the query.
+func listenTcpURL(u *url.URL) (Server, error) {
+	var opts []TcpServerOption
+	opts = append(opts, TcpSNetwork(u.Scheme), TcpSLocalAddr(tcpURLAddr(u)), TcpSHeadLen(2))
+
+	q := newURLQuery(u)
+	add := func(opt TcpServerOption) { opts = append(opts, opt) }
+	q.int("head", func(n int) { add(TcpSHeadLen(n)) })
+	q.bool("le", func(b bool) { add(TcpSLittleEndian(b)) })
+	q.int("maxmsg", func(n int) { add(TcpSMaxMsgLen(uint32(n))) })
+	q.int("maxclients", func(n int) { add(TcpSMaxClientCount(n)) })
+	q.int("writebuff", func(n int) { add(TcpSWriteBuffCap(n)) })
+	q.int("reuseport", func(n int) { add(TcpSReusePort(n)) })
+	q.string("systemd", func(name string) { add(TcpSSystemdName(name)) })
+
+	var grace time.Duration
+	var replayCap int
+	q.duration("session", func(d time.Duration) { grace = d })
+	q.int("replay", func(n int) { replayCap = n })
+	if grace > 0 {
+		add(TcpSSession(grace, replayCap))
+	}
+
+	if err := q.done(true); nil != err {
+		return nil, err
+	}
+	return NewTcpServer(opts...), nil
+}
+
+// dialTcpURL takes head, le, maxmsg, writebuff, reconnect, conns,
+// dialtimeout, session and replay from the query.
+func dialTcpURL(u *url.URL) (Client, error) {
+	var opts []TcpClientOption
+	opts = append(opts, TcpCNetwork(u.Scheme), TcpCRemoteAddr(tcpURLAddr(u)), TcpCReadHeadLen(2))
+
+	q := newURLQuery(u)
+	add := func(opt TcpClientOption) { opts = append(opts, opt) }
+	q.int("head", func(n int) { add(TcpCReadHeadLen(n)) })
+	q.bool("le", func(b bool) { add(TcpCLittleEndian(b)) })
+	q.int("maxmsg", func(n int) { add(TcpCMaxMsgLen(uint32(n))) })
+	q.int("writebuff", func(n int) { add(TcpCWriteBuffCap(n)) })
+	q.bool("reconnect", func(b bool) { add(TcpCAutoReconnect(b)) })
+	q.int("conns", func(n int) { add(TcpCConnCount(n)) })
+	q.duration("dialtimeout", func(d time.Duration) { add(TcpCDialTimeout(d)) })
+
+	var grace time.Duration
+	var replayCap int
+	q.duration("session", func(d time.Duration) { grace = d })
+	q.int("replay", func(n int) { replayCap = n })
+	if grace > 0 {
+		add(TcpCSession(grace, replayCap))
+	}
+
+	if err := q.done(true); nil != err {
+		return nil, err
+	}
+	return NewTcpClient(opts...), nil
+}
+
+// listenWSURL serves on the path of the url and takes maxmsg, maxclients,
+// writebuff, timeout, text, health, cert, key and systemd from the query.
+func listenWSURL(u *url.URL) (Server, error) {
+	var opts []WSServerOption
+	opts = append(opts, WSSLocalAddr(u.Host))
+	if u.Path != "" && u.Path != "/" {
+		opts = append(opts, WSSPath(u.Path))
+	}
+
+	q := newURLQuery(u)
+	add := func(opt WSServerOption) { opts = append(opts, opt) }
+	q.int("maxmsg", func(n int) { add(WSSMaxMsgLen(uint32(n))) })
+	q.int("maxclients", func(n int) { add(WSSMaxClientCount(n)) })
+	q.int("writebuff", func(n int) { add(WSSWriteBuffCap(n)) })
+	q.duration("timeout", func(d time.Duration) { add(WSSHTTPTimeout(d)) })
+	q.bool("text", func(b bool) {
+		if b {
+			add(WSSMessageType(WSTextMessage))
+		}
+	})
+	q.bool("health", func(b bool) {
+		if b {
+			add(WSSHealth())
+		}
+	})
+	q.string("systemd", func(name string) { add(WSSSystemdName(name)) })
+
+	var certFile, keyFile string
+	q.string("cert", func(f string) { certFile = f })
+	q.string("key", func(f string) { keyFile = f })
+
+	if err := q.done(true); nil != err {
+		return nil, err
+	}
+	if u.Scheme == "wss" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("wss needs cert and key")
+		}
+		add(WSSCertFile(certFile))
+		add(WSSKeyFile(keyFile))
+	}
+	return NewWSServer(opts...), nil
+}
+
+// dialWSURL takes maxmsg, writebuff, reconnect, conns, dialtimeout,
+// handshaketimeout and text from the query, the other query values stay in
+// the url.
+func dialWSURL(u *url.URL) (Client, error) {
+	var opts []WSClientOption
+
+	q := newURLQuery(u)
+	add := func(opt WSClientOption) { opts = append(opts, opt) }
+	q.int("maxmsg", func(n int) { add(WSCMaxMsgLen(uint32(n))) })
+	q.int("writebuff", func(n int) { add(WSCWriteBuffCap(n)) })
+	q.bool("reconnect", func(b bool) { add(WSCAutoReconnect(b)) })
+	q.int("conns", func(n int) { add(WSCConnCount(n)) })
+	q.duration("dialtimeout", func(d time.Duration) { add(WSCDialTimeout(d)) })
+	q.duration("handshaketimeout", func(d time.Duration) { add(WSCHandshakeTimeout(d)) })
+	q.bool("text", func(b bool) {
+		if b {
+			add(WSCMessageType(WSTextMessage))
+		}
+	})
+
+	if err := q.done(false); nil != err {
+		return nil, err
+	}
+
+	remote := *u
+	remote.RawQuery = q.values.Encode()
+	opts = append(opts, WSCRemoteAddr(remote.String()))
+	return NewWSClient(opts...), nil
+}
@@ -1,47 +1,120 @@
 package go_net
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-	
+
 	"github.com/gorilla/websocket"
 	"github.com/hezhis/go_log"
 )
 
 type (
 	WSClient struct {
-		pParam  *CreateConnectorParam
-		pConn   *websocket.Conn
-		pLocker *Locker
+		pParam         *CreateConnectorParam
+		pRetryParam    *RetryParam
+		pEndpointParam *EndpointParam
+		pEndpoints     *endpointSet
+		pSendParam     *SendQueueParam
+		pSendQueue     *sendQueue
+		pLocker        *Locker
 
 		bAutoReconnect    bool
 		bClosed           bool
-		sRemoteAddr       string
 		nConnectInterval  time.Duration
 		nHandshakeTimeout time.Duration
+		nDialTimeout      time.Duration
+		nConnCount        int
+		nMessageType      int
+		sURLTemplate      string
+
+		header         http.Header
+		headerFunc     func() (http.Header, error)
+		pTLSConfig     *tls.Config
+		proxy          func(*http.Request) (*url.URL, error)
+		jar            http.CookieJar
+		asSubprotocols []string
+		nReadBuffSize  int
+		nWriteBuffSize int
 
 		NewAgent func(*WSConnector) Agent
 
 		dialer    websocket.Dialer
+		connMutex sync.Mutex
+		connSet   map[*websocket.Conn]struct{}
+		nRunning  int32
 		uConnWait sync.WaitGroup
+
+		ctx           context.Context
+		cancel        context.CancelFunc
+		cConnected    chan struct{}
+		cDone         chan struct{}
+		connectedOnce sync.Once
 	}
 	WSClientOption func(c *WSClient)
 )
 
 func NewWSClient(opts ...WSClientOption) *WSClient {
-	client := &WSClient{pParam: &CreateConnectorParam{}}
+	client := &WSClient{
+		pParam:         &CreateConnectorParam{},
+		pRetryParam:    &RetryParam{},
+		pEndpointParam: &EndpointParam{},
+		pSendParam:     &SendQueueParam{},
+	}
 	client.pLocker = NewLocker()
+	client.connSet = make(map[*websocket.Conn]struct{})
+	client.cConnected = make(chan struct{})
+	client.cDone = make(chan struct{})
 	for _, opt := range opts {
 		opt(client)
 	}
+	client.pSendQueue = newSendQueue(client.pSendParam)
 	return client
 }
 
+// SetNewAgent sets NewAgent through the transport independent Connector.
+func (c *WSClient) SetNewAgent(newAgent func(Connector) Agent) {
+	c.NewAgent = func(connector *WSConnector) Agent {
+		return newAgent(connector)
+	}
+}
+
+// Start is StartContext(context.Background()).
 func (c *WSClient) Start() {
+	c.StartContext(context.Background())
+}
+
+// StartContext starts the client, dialing and backoff stop as soon as ctx ends
+// and the current connection is closed.
+func (c *WSClient) StartContext(ctx context.Context) {
 	c.init()
+	c.ctx, c.cancel = context.WithCancel(ctx)
 
-	c.uConnWait.Add(1)
-	go c.connect()
+	c.uConnWait.Add(1 + c.nConnCount)
+	c.nRunning = int32(c.nConnCount)
+	go c.watch()
+	for i := 0; i < c.nConnCount; i++ {
+		go c.connect()
+	}
+}
+
+// WaitConnected blocks until the first connection is established, the client
+// stops connecting or ctx ends.
+func (c *WSClient) WaitConnected(ctx context.Context) error {
+	select {
+	case <-c.cConnected:
+		return nil
+	case <-c.cDone:
+		return ErrClientClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (c *WSClient) init() {
@@ -67,72 +140,222 @@ func (c *WSClient) init() {
 	if c.NewAgent == nil {
 		logger.Fatal("NewAgent must not be nil")
 	}
+	if nil == c.pRetryParam.pBackoff {
+		c.pRetryParam.pBackoff = &ConstantBackoff{Interval: c.nConnectInterval}
+	}
+	if len(c.pEndpointParam.asAddrs) == 0 && nil == c.pEndpointParam.pResolver {
+		logger.Fatal("remote addr must not be empty")
+	}
+	if c.nConnCount <= 0 {
+		c.nConnCount = 1
+	}
+	if nil != c.pEndpointParam.pResolver && len(c.pEndpointParam.asAddrs) > 0 {
+		c.sURLTemplate = c.pEndpointParam.asAddrs[0]
+	}
+	c.pEndpoints = newEndpointSet(c.pEndpointParam)
 
 	c.bClosed = false
 	c.dialer = websocket.Dialer{
 		HandshakeTimeout: c.nHandshakeTimeout,
+		TLSClientConfig:  c.pTLSConfig,
+		Proxy:            c.proxy,
+		Jar:              c.jar,
+		Subprotocols:     c.asSubprotocols,
+		ReadBufferSize:   c.nReadBuffSize,
+		WriteBufferSize:  c.nWriteBuffSize,
+	}
+	if nil != c.pParam.pCompress {
+		c.dialer.EnableCompression = true
+		c.dialer.NetDialContext = dialWire
+	}
+}
+
+func (c *WSClient) watch() {
+	defer c.uConnWait.Done()
+
+	<-c.ctx.Done()
+	c.shutdown()
+}
+
+// requestHeader merges the static headers with those of the header func,
+// which runs again for every connection attempt.
+func (c *WSClient) requestHeader() (http.Header, error) {
+	if nil == c.headerFunc {
+		return c.header, nil
+	}
+
+	header := c.header.Clone()
+	if nil == header {
+		header = make(http.Header)
+	}
+	extra, err := c.headerFunc()
+	if nil != err {
+		return nil, err
 	}
+	for key, values := range extra {
+		header[key] = values
+	}
+	return header, nil
 }
 
-func (c *WSClient) dial() *websocket.Conn {
+// dial returns the connection to an endpoint and the handshake response, wire
+// is set when permessage-deflate got negotiated.
+func (c *WSClient) dial(retry *retryState) (*websocket.Conn, *http.Response, *wireConn, *endpoint) {
 	for {
-		conn, _, err := c.dialer.Dial(c.sRemoteAddr, nil)
-		if err == nil || c.bClosed {
-			return conn
+		c.pEndpoints.resolve(c.ctx)
+		ep := c.pEndpoints.pick()
+		if nil == ep {
+			logger.Error("connect error: %v", ErrNoEndpoint)
+			delay, ok := retry.dialFailed("", ErrNoEndpoint)
+			if !ok || !sleepContext(c.ctx, delay) {
+				return nil, nil, nil, nil
+			}
+			continue
+		}
+
+		header, err := c.requestHeader()
+		if nil == err {
+			ctx, cancel := c.ctx, context.CancelFunc(func() {})
+			if c.nDialTimeout > 0 {
+				ctx, cancel = context.WithTimeout(c.ctx, c.nDialTimeout)
+			}
+			var wire *wireConn
+			ctx = context.WithValue(ctx, wireKey{}, &wire)
+
+			var conn *websocket.Conn
+			var resp *http.Response
+			conn, resp, err = c.dialer.DialContext(ctx, c.endpointURL(ep.sAddr), header)
+			cancel()
+			if nil == err {
+				if nil == resp || !deflateNegotiated(resp.Header) {
+					wire = nil
+				}
+				return conn, resp, wire, ep
+			}
+			if nil != resp {
+				err = fmt.Errorf("%v, status %v", err, resp.Status)
+			}
+		}
+		if nil != c.ctx.Err() {
+			c.pEndpoints.disconnected(ep)
+			return nil, nil, nil, nil
+		}
+
+		logger.Error("connect to %v error: %v", ep.sAddr, err)
+		c.pEndpoints.dialFailed(ep)
+		delay, ok := retry.dialFailed(ep.sAddr, err)
+		if !ok || !sleepContext(c.ctx, delay) {
+			return nil, nil, nil, nil
 		}
+	}
+}
+
+// endpointURL turns a resolved host:port into a dial url, scheme and path are
+// taken from the remote addr given with WSCRemoteAddr.
+func (c *WSClient) endpointURL(addr string) string {
+	if strings.Contains(addr, "://") {
+		return addr
+	}
 
-		logger.Error("connect to %v error: %v", c.sRemoteAddr, err)
-		time.Sleep(c.nConnectInterval)
-		continue
+	u, err := url.Parse(c.sURLTemplate)
+	if nil != err || u.Scheme == "" {
+		return "ws://" + addr
 	}
+	u.Host = addr
+	return u.String()
 }
 
 func (c *WSClient) connect() {
 	defer c.uConnWait.Done()
+	defer func() {
+		if atomic.AddInt32(&c.nRunning, -1) == 0 {
+			close(c.cDone)
+		}
+	}()
+
+	retry := newRetryState(c.pRetryParam)
 
 reconnect:
-	conn := c.dial()
+	conn, resp, wire, ep := c.dial(retry)
 	if conn == nil {
 		return
 	}
 	conn.SetReadLimit(int64(c.pParam.nMaxMsgLength))
 
-	c.pLocker.Lock()
+	c.connMutex.Lock()
 	if c.bClosed {
-		c.pLocker.Unlock()
+		c.connMutex.Unlock()
 		conn.Close()
+		c.pEndpoints.disconnected(ep)
 		return
 	}
-	c.pConn = conn
-	c.pLocker.Unlock()
+	c.connSet[conn] = struct{}{}
+	c.connMutex.Unlock()
+	c.pEndpoints.connected(ep)
 
-	wsConn := newWSConnector(conn, c.pParam)
+	c.connectedOnce.Do(func() {
+		close(c.cConnected)
+	})
+
+	connectedAt := time.Now()
+	wsConn := newWSConnector(conn, c.pParam, c.nMessageType, nil != wire, wire)
+	wsConn.pResponse = resp
 	agent := c.NewAgent(wsConn)
+	c.pSendQueue.attach(wsConn)
 	agent.LogicRun()
+	c.pSendQueue.detach(wsConn)
 
 	// cleanup
 	wsConn.Close()
-	c.pLocker.Lock()
-	c.pConn = nil
-	c.pLocker.Unlock()
+	c.connMutex.Lock()
+	delete(c.connSet, conn)
+	c.connMutex.Unlock()
+	c.pEndpoints.disconnected(ep)
 	agent.OnClose()
 
-	if c.bAutoReconnect {
-		time.Sleep(c.nConnectInterval)
+	if c.bAutoReconnect && nil == c.ctx.Err() {
+		delay, ok := retry.disconnected(time.Since(connectedAt))
+		if !ok || !sleepContext(c.ctx, delay) {
+			return
+		}
 		goto reconnect
 	}
 }
 
-func (c *WSClient) Close() {
-	c.pLocker.Lock()
+// Send writes a message through one of the connections, while the client is
+// disconnected messages are queued and flushed in order after reconnecting.
+// Delivery is at most once, a message handed to a connection is lost when the
+// connection drops before writing it.
+func (c *WSClient) Send(args ...[]byte) error {
+	return c.pSendQueue.send(args...)
+}
+
+func (c *WSClient) shutdown() {
+	c.connMutex.Lock()
+	defer c.connMutex.Unlock()
+
 	if !c.bClosed {
 		c.bClosed = true
-		if nil != c.pConn {
-			c.pConn.Close()
-			c.pConn = nil
+		deadline := time.Now().Add(wsCloseTimeout)
+		for conn := range c.connSet {
+			closeGoingAway(conn, deadline)
 		}
+		c.connSet = nil
+	}
+}
+
+// CompressionStats returns the counters of the messages and streams sent
+// compressed.
+func (c *WSClient) CompressionStats() CompressionStats {
+	return c.pParam.pCompress.stats()
+}
+
+func (c *WSClient) Close() {
+	if nil != c.cancel {
+		c.cancel()
 	}
+	c.shutdown()
 
-	c.pLocker.Unlock()
 	c.uConnWait.Wait()
+	closeResolver(c.pEndpointParam.pResolver)
 }
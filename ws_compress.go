@@ -0,0 +1,121 @@
+package go_net
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type (
+	// CompressParam enables permessage-deflate, messages shorter than
+	// nThreshold are sent uncompressed.
+	CompressParam struct {
+		nLevel     int
+		nThreshold int
+
+		nMessages  uint64
+		nRawBytes  uint64
+		nWireBytes uint64
+	}
+
+	// CompressionStats counts the messages sent compressed. WireBytes
+	// includes the frame headers, Ratio is WireBytes over RawBytes.
+	CompressionStats struct {
+		Messages  uint64 `json:"messages"`
+		RawBytes  uint64 `json:"raw_bytes"`
+		WireBytes uint64 `json:"wire_bytes"`
+	}
+
+	// wireConn counts the bytes written to a compressed connection.
+	wireConn struct {
+		net.Conn
+		nWritten uint64
+
+		closeOnce sync.Once
+		onClose   func()
+	}
+
+	// wireKey carries the **wireConn dialWire fills in through the dial ctx.
+	wireKey struct{}
+)
+
+func (s CompressionStats) Ratio() float64 {
+	if 0 == s.RawBytes {
+		return 0
+	}
+	return float64(s.WireBytes) / float64(s.RawBytes)
+}
+
+func (p *CompressParam) add(raw, wire int) {
+	atomic.AddUint64(&p.nMessages, 1)
+	atomic.AddUint64(&p.nRawBytes, uint64(raw))
+	atomic.AddUint64(&p.nWireBytes, uint64(wire))
+}
+
+func (p *CompressParam) stats() CompressionStats {
+	if nil == p {
+		return CompressionStats{}
+	}
+	return CompressionStats{
+		Messages:  atomic.LoadUint64(&p.nMessages),
+		RawBytes:  atomic.LoadUint64(&p.nRawBytes),
+		WireBytes: atomic.LoadUint64(&p.nWireBytes),
+	}
+}
+
+func (c *wireConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.nWritten, uint64(n))
+	return n, err
+}
+
+func (c *wireConn) Close() error {
+	if nil != c.onClose {
+		c.closeOnce.Do(c.onClose)
+	}
+	return c.Conn.Close()
+}
+
+func (c *wireConn) written() uint64 {
+	return atomic.LoadUint64(&c.nWritten)
+}
+
+// deflateNegotiated reports whether the Sec-WebSocket-Extensions of h offer
+// or accept permessage-deflate. The upgrader accepts it whenever the request
+// offers it and compression is enabled.
+func deflateNegotiated(h http.Header) bool {
+	for _, value := range h.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(value, ",") {
+			name := strings.TrimSpace(strings.SplitN(ext, ";", 2)[0])
+			if strings.EqualFold(name, "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tcpConnOf returns the tcp connection under conn, or nil.
+func tcpConnOf(conn net.Conn) *net.TCPConn {
+	if wire, ok := conn.(*wireConn); ok {
+		conn = wire.Conn
+	}
+	tcpConn, _ := conn.(*net.TCPConn)
+	return tcpConn
+}
+
+func dialWire(ctx context.Context, network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if nil != err {
+		return nil, err
+	}
+	wire := &wireConn{Conn: conn}
+	if holder, ok := ctx.Value(wireKey{}).(**wireConn); ok {
+		*holder = wire
+	}
+	return wire, nil
+}
@@ -2,33 +2,133 @@ package go_net
 
 import (
 	"errors"
+	"io"
 	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/hezhis/go_log"
 )
 
-type WSConnector struct {
-	pConn   *websocket.Conn
-	pLocker *Locker
+// the websocket frame types of messages
+const (
+	WSTextMessage   = websocket.TextMessage
+	WSBinaryMessage = websocket.BinaryMessage
+)
 
-	bClosed bool
+var ErrMessageType = errors.New("message type must be text or binary")
+
+// the close codes of RFC 6455
+const (
+	WSCloseNormalClosure     = websocket.CloseNormalClosure
+	WSCloseGoingAway         = websocket.CloseGoingAway
+	WSCloseProtocolError     = websocket.CloseProtocolError
+	WSCloseUnsupportedData   = websocket.CloseUnsupportedData
+	WSCloseNoStatusReceived  = websocket.CloseNoStatusReceived
+	WSCloseAbnormalClosure   = websocket.CloseAbnormalClosure
+	WSCloseInvalidPayload    = websocket.CloseInvalidFramePayloadData
+	WSClosePolicyViolation   = websocket.ClosePolicyViolation
+	WSCloseMessageTooBig     = websocket.CloseMessageTooBig
+	WSCloseInternalServerErr = websocket.CloseInternalServerErr
+	WSCloseServiceRestart    = websocket.CloseServiceRestart
+	WSCloseTryAgainLater     = websocket.CloseTryAgainLater
+)
 
-	nMaxMsgLength  uint32
-	cWriteBuffChan chan []byte
-}
+const (
+	// wsCloseTimeout bounds the write of a close frame and the wait for the
+	// close frame of the peer.
+	wsCloseTimeout = time.Second
+	// wsMaxCloseReason leaves room for the code in a 125 byte control frame.
+	wsMaxCloseReason = 123
+)
+
+// WSCloseError is the error ReadMsg returns when the peer sent a close frame.
+type WSCloseError = websocket.CloseError
+
+type (
+	WSConnector struct {
+		pConn   *websocket.Conn
+		pLocker *Locker
+
+		bClosed bool
+
+		nMaxMsgLength    uint32
+		nMaxStreamLength int64
+		nMessageType     int
+		cWriteBuffChan   chan wsMessage
+		cDrained         chan struct{}
+
+		// messages written while a stream is open wait in held for its end
+		streamLocker sync.Mutex
+		bStreaming   bool
+		held         []wsMessage
+
+		pWire     *wireConn
+		pCompress *CompressParam
+
+		pURL      *url.URL
+		header    http.Header
+		pResponse *http.Response
+
+		readOnce     sync.Once
+		cReadDone    chan struct{}
+		nCloseCode   int
+		sCloseReason string
+	}
+
+	// wsMessage is a whole message or a part of a stream, the writer ends
+	// the stream at the part with bFin set.
+	wsMessage struct {
+		nType   int
+		data    []byte
+		bStream bool
+		bFin    bool
+	}
+
+	// wsOutStream is the stream the writer is sending, w is nil between
+	// streams.
+	wsOutStream struct {
+		w         io.WriteCloser
+		bCompress bool
+		nRaw      int
+		nWire     uint64
+	}
+)
 
-func newWSConnector(conn *websocket.Conn, param *CreateConnectorParam) *WSConnector {
+// newWSConnector creates the connector of conn, WriteMsg sends frames of
+// messageType. compressed is set when permessage-deflate got negotiated, wire
+// counts the bytes written to conn and may be nil.
+func newWSConnector(conn *websocket.Conn, param *CreateConnectorParam, messageType int, compressed bool, wire *wireConn) *WSConnector {
 	c := &WSConnector{}
 	c.pLocker = NewLocker()
 	c.pConn = conn
+	c.cReadDone = make(chan struct{})
+
+	if compressed && nil != param.pCompress {
+		c.pWire = wire
+		c.pCompress = param.pCompress
+		if err := conn.SetCompressionLevel(c.pCompress.nLevel); nil != err {
+			logger.Error("set compression level error: %v", err)
+		}
+	}
 
-	if 0 == param.nWriteBuffCap {
-		param.nWriteBuffCap = 1024
+	// the connections of a client share param
+	writeBuffCap := param.nWriteBuffCap
+	if 0 == writeBuffCap {
+		writeBuffCap = 1024
 	}
 
 	c.nMaxMsgLength = param.nMaxMsgLength
-	c.cWriteBuffChan = make(chan []byte, param.nWriteBuffCap)
+	c.nMaxStreamLength = param.nMaxStreamLength
+	c.nMessageType = messageType
+	if c.nMessageType != WSTextMessage {
+		c.nMessageType = WSBinaryMessage
+	}
+	c.cWriteBuffChan = make(chan wsMessage, writeBuffCap)
+	c.cDrained = make(chan struct{}, 1)
 
 	go c.startWriter(conn)
 
@@ -36,26 +136,129 @@ func newWSConnector(conn *websocket.Conn, param *CreateConnectorParam) *WSConnec
 }
 
 func (c *WSConnector) startWriter(conn *websocket.Conn) {
-	for b := range c.cWriteBuffChan {
-		if b == nil {
+	var stream wsOutStream
+	for msg := range c.cWriteBuffChan {
+		if msg.data == nil {
+			break
+		}
+		if msg.nType == websocket.CloseMessage {
+			c.writeClose(conn, msg.data)
 			break
 		}
 
-		if err := conn.WriteMessage(websocket.BinaryMessage, b); nil != err {
+		var err error
+		if msg.bStream {
+			err = c.writeStream(conn, &stream, msg)
+		} else {
+			err = c.writeMessage(conn, msg)
+		}
+		if nil != err {
 			logger.Error("%v", err)
 			break
 		}
+		notifyDrained(c.cDrained)
 	}
 
 	conn.Close()
+	close(c.cDrained)
 
 	c.pLocker.Lock()
 	c.bClosed = true
 	c.pLocker.Unlock()
 }
 
+// writeMessage writes msg, compressed when it reaches the threshold.
+func (c *WSConnector) writeMessage(conn *websocket.Conn, msg wsMessage) error {
+	if nil == c.pCompress {
+		return conn.WriteMessage(msg.nType, msg.data)
+	}
+
+	compress := len(msg.data) >= c.pCompress.nThreshold
+	conn.EnableWriteCompression(compress)
+
+	var before uint64
+	if nil != c.pWire {
+		before = c.pWire.written()
+	}
+	if err := conn.WriteMessage(msg.nType, msg.data); nil != err {
+		return err
+	}
+	if compress && nil != c.pWire {
+		c.pCompress.add(len(msg.data), int(c.pWire.written()-before))
+	}
+	return nil
+}
+
+// writeClose sends a close frame and gives the peer a moment to answer it
+// before the connection is closed, the answer is taken by ReadMsg.
+func (c *WSConnector) writeClose(conn *websocket.Conn, data []byte) {
+	// fails with ErrCloseSent when the close frame of the peer got answered
+	if err := conn.WriteControl(websocket.CloseMessage, data, time.Now().Add(wsCloseTimeout)); nil != err {
+		return
+	}
+
+	timer := time.NewTimer(wsCloseTimeout)
+	defer timer.Stop()
+	select {
+	case <-c.cReadDone:
+	case <-timer.C:
+	}
+}
+
+// closeGoingAway tells the peer the endpoint goes away and closes conn.
+func closeGoingAway(conn *websocket.Conn, deadline time.Time) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(WSCloseGoingAway, ""), deadline)
+	conn.Close()
+}
+
+// writeStream writes a part of a stream. A stream is compressed unless it
+// ends with a first part shorter than the threshold, it's counted in the
+// compression stats once it ended.
+func (c *WSConnector) writeStream(conn *websocket.Conn, s *wsOutStream, msg wsMessage) error {
+	if nil == s.w {
+		s.bCompress = nil != c.pCompress && (!msg.bFin || len(msg.data) >= c.pCompress.nThreshold)
+		s.nRaw = 0
+		if nil != c.pWire {
+			s.nWire = c.pWire.written()
+		}
+		conn.EnableWriteCompression(s.bCompress)
+
+		var err error
+		if s.w, err = conn.NextWriter(msg.nType); nil != err {
+			return err
+		}
+	}
+	if _, err := s.w.Write(msg.data); nil != err {
+		return err
+	}
+	s.nRaw += len(msg.data)
+	if !msg.bFin {
+		return nil
+	}
+
+	err := s.w.Close()
+	s.w = nil
+	if nil == err && s.bCompress && nil != c.pWire {
+		c.pCompress.add(s.nRaw, int(c.pWire.written()-s.nWire))
+	}
+	return err
+}
+
+// waitRoom waits until the write queue holds less than roomQueueLength
+// messages, it fails once the connection is closed.
+func (c *WSConnector) waitRoom() error {
+	for len(c.cWriteBuffChan) >= roomQueueLength(cap(c.cWriteBuffChan)) {
+		if _, ok := <-c.cDrained; !ok {
+			return ErrConnClosed
+		}
+	}
+	return drainedOpen(c.cDrained)
+}
+
 func (c *WSConnector) doDestroy() {
-	c.pConn.UnderlyingConn().(*net.TCPConn).SetLinger(0)
+	if tcpConn := tcpConnOf(c.pConn.UnderlyingConn()); nil != tcpConn {
+		tcpConn.SetLinger(0)
+	}
 	c.pConn.Close()
 
 	if !c.bClosed {
@@ -71,25 +274,62 @@ func (c *WSConnector) Destroy() {
 	c.doDestroy()
 }
 
+// Close closes the connection with WSCloseNormalClosure.
 func (c *WSConnector) Close() {
+	c.CloseWithCode(WSCloseNormalClosure, "")
+}
+
+// CloseWithCode sends a close frame with code and reason after the queued
+// messages and closes the connection.
+func (c *WSConnector) CloseWithCode(code int, reason string) error {
+	if len(reason) > wsMaxCloseReason {
+		return errors.New("close reason too long")
+	}
+
 	c.pLocker.Lock()
 	defer c.pLocker.Unlock()
 	if c.bClosed {
-		return
+		return nil
 	}
 
-	c.doWrite(nil)
+	c.doWrite(wsMessage{nType: websocket.CloseMessage, data: websocket.FormatCloseMessage(code, reason)})
 	c.bClosed = true
+	return nil
+}
+
+// CloseStatus returns the close code and reason the peer sent. The code is
+// WSCloseAbnormalClosure when the connection ended without a close frame and
+// 0 while reading has not failed yet.
+func (c *WSConnector) CloseStatus() (int, string) {
+	select {
+	case <-c.cReadDone:
+		return c.nCloseCode, c.sCloseReason
+	default:
+		return 0, ""
+	}
+}
+
+// readFailed keeps the close status of the first read error.
+func (c *WSConnector) readFailed(err error) {
+	c.readOnce.Do(func() {
+		c.nCloseCode = WSCloseAbnormalClosure
+		var closeErr *WSCloseError
+		if errors.As(err, &closeErr) {
+			c.nCloseCode = closeErr.Code
+			c.sCloseReason = closeErr.Text
+		}
+		close(c.cReadDone)
+	})
 }
 
-func (c *WSConnector) doWrite(b []byte) {
+func (c *WSConnector) doWrite(msg wsMessage) {
 	if len(c.cWriteBuffChan) == cap(c.cWriteBuffChan) {
 		logger.Error("close conn: channel full")
 		c.doDestroy()
 		return
 	}
 
-	c.cWriteBuffChan <- b
+	c.cWriteBuffChan <- msg
 }
 
 func (c *WSConnector) LocalAddr() net.Addr {
@@ -100,12 +340,88 @@ func (c *WSConnector) RemoteAddr() net.Addr {
 	return c.pConn.RemoteAddr()
 }
 
+// Path returns the path of the upgrade request, empty on the client side.
+func (c *WSConnector) Path() string {
+	if nil == c.pURL {
+		return ""
+	}
+	return c.pURL.Path
+}
+
+// Query returns the query of the upgrade request, nil on the client side.
+func (c *WSConnector) Query() url.Values {
+	if nil == c.pURL {
+		return nil
+	}
+	return c.pURL.Query()
+}
+
+// Header returns the headers of the upgrade request, nil on the client side.
+func (c *WSConnector) Header() http.Header {
+	return c.header
+}
+
+// Response returns the handshake response on the client side.
+func (c *WSConnector) Response() *http.Response {
+	return c.pResponse
+}
+
+// Subprotocol returns the subprotocol negotiated in the handshake.
+func (c *WSConnector) Subprotocol() string {
+	return c.pConn.Subprotocol()
+}
+
+// SetMessageType sets the frame type WriteMsg sends, WSTextMessage or
+// WSBinaryMessage, other types are rejected with ErrMessageType.
+func (c *WSConnector) SetMessageType(messageType int) error {
+	if messageType != WSTextMessage && messageType != WSBinaryMessage {
+		return ErrMessageType
+	}
+
+	// writeMsg and the stream writers read it under streamLocker
+	c.streamLocker.Lock()
+	defer c.streamLocker.Unlock()
+
+	c.nMessageType = messageType
+	return nil
+}
+
+// ReadMsg reads a message, the error is a *WSCloseError when the peer closed
+// the connection with a close frame.
 func (c *WSConnector) ReadMsg() ([]byte, error) {
-	_, b, err := c.pConn.ReadMessage()
+	_, b, err := c.ReadMsgType()
 	return b, err
 }
 
+// ReadMsgType reads a message along with its frame type.
+func (c *WSConnector) ReadMsgType() (int, []byte, error) {
+	c.pConn.SetReadLimit(int64(c.nMaxMsgLength))
+	messageType, b, err := c.pConn.ReadMessage()
+	if nil != err {
+		c.readFailed(err)
+	}
+	return messageType, b, err
+}
+
+// WriteMsg sends args as one message of the default frame type.
 func (c *WSConnector) WriteMsg(args ...[]byte) error {
+	return c.writeMsg(0, args...)
+}
+
+func (c *WSConnector) WriteText(args ...[]byte) error {
+	return c.writeMsg(WSTextMessage, args...)
+}
+
+func (c *WSConnector) WriteBinary(args ...[]byte) error {
+	return c.writeMsg(WSBinaryMessage, args...)
+}
+
+// writeMsg sends args as one message of messageType, 0 is the default type.
+// While a stream is written the message is sent after the stream.
+func (c *WSConnector) writeMsg(messageType int, args ...[]byte) error {
+	c.streamLocker.Lock()
+	defer c.streamLocker.Unlock()
+
 	c.pLocker.Lock()
 	defer c.pLocker.Unlock()
 	if c.bClosed {
@@ -125,10 +441,13 @@ func (c *WSConnector) WriteMsg(args ...[]byte) error {
 		return errors.New("message too short")
 	}
 
+	if 0 == messageType {
+		messageType = c.nMessageType
+	}
+
 	// don't copy
 	if len(args) == 1 {
-		c.doWrite(args[0])
-		return nil
+		return c.queue(wsMessage{nType: messageType, data: args[0]})
 	}
 
 	// merge the args
@@ -139,7 +458,28 @@ func (c *WSConnector) WriteMsg(args ...[]byte) error {
 		l += len(args[i])
 	}
 
-	c.doWrite(msg)
+	return c.queue(wsMessage{nType: messageType, data: msg})
+}
 
+// queue writes msg or holds it back while a stream is open, it must be called
+// with streamLocker held.
+func (c *WSConnector) queue(msg wsMessage) error {
+	if !c.bStreaming {
+		c.doWrite(msg)
+		return nil
+	}
+	if len(c.held) >= cap(c.cWriteBuffChan) {
+		return ErrStreamPending
+	}
+	c.held = append(c.held, msg)
 	return nil
 }
+
+// dropHeld ends a failed stream, it must be called with streamLocker held.
+func (c *WSConnector) dropHeld(err error) {
+	if len(c.held) > 0 {
+		logger.Error("drop %v messages held back by a failed stream: %v", len(c.held), err)
+	}
+	c.held = nil
+	c.bStreaming = false
+}
@@ -0,0 +1,190 @@
+package go_net
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/hezhis/go_log"
+)
+
+type (
+	HealthOption func(p *HealthParam)
+
+	// HealthParam describes the health endpoints of a WSServer, an empty
+	// path turns its endpoint off.
+	HealthParam struct {
+		sHealthPath string
+		sReadyPath  string
+		sStatusPath string
+		sAdminAddr  string
+	}
+
+	// WSServerStatus is the json the status endpoint returns.
+	WSServerStatus struct {
+		Ready         bool             `json:"ready"`
+		ShuttingDown  bool             `json:"shutting_down"`
+		UptimeSeconds float64          `json:"uptime_seconds"`
+		Sessions      int              `json:"sessions"`
+		MaxSessions   int              `json:"max_sessions"`
+		Paths         []WSPathStatus   `json:"paths"`
+		Compression   CompressionStats `json:"compression"`
+	}
+
+	WSPathStatus struct {
+		Path        string `json:"path,omitempty"`
+		Sessions    int    `json:"sessions"`
+		MaxSessions int    `json:"max_sessions"`
+	}
+)
+
+func HealthPath(path string) HealthOption {
+	return func(p *HealthParam) {
+		p.sHealthPath = path
+	}
+}
+
+func ReadyPath(path string) HealthOption {
+	return func(p *HealthParam) {
+		p.sReadyPath = path
+	}
+}
+
+func StatusPath(path string) HealthOption {
+	return func(p *HealthParam) {
+		p.sStatusPath = path
+	}
+}
+
+// HealthAdminAddr serves the endpoints on a listener of their own instead of
+// the websocket listeners, it stays open until Shutdown returns.
+func HealthAdminAddr(addr string) HealthOption {
+	return func(p *HealthParam) {
+		p.sAdminAddr = addr
+	}
+}
+
+func newHealthParam(opts ...HealthOption) *HealthParam {
+	p := &HealthParam{
+		sHealthPath: "/healthz",
+		sReadyPath:  "/readyz",
+		sStatusPath: "/status",
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// checkPaths fails when a health endpoint served on the websocket listeners
+// would hide the path of the server or one of its routes.
+func (p *HealthParam) checkPaths(s *WSServer) error {
+	if p.sAdminAddr != "" {
+		return nil
+	}
+	for _, path := range []string{p.sHealthPath, p.sReadyPath, p.sStatusPath} {
+		if path == "" {
+			continue
+		}
+		if _, ok := s.routes[path]; ok || (path == s.sPath && nil != s.NewAgent) {
+			return fmt.Errorf("health endpoint %v conflicts with a websocket path, change it or use HealthAdminAddr", path)
+		}
+	}
+	return nil
+}
+
+// sessionCount returns the connections of the handler.
+func (handler *WSHandler) sessionCount() int {
+	handler.connMutex.Lock()
+	defer handler.connMutex.Unlock()
+
+	return len(handler.connSet)
+}
+
+// Status returns the sessions of every path. The server is not ready while
+// shutting down or once the sessions of all paths reach their limits.
+func (s *WSServer) Status() WSServerStatus {
+	s.Handler()
+
+	status := WSServerStatus{
+		ShuttingDown:  atomic.LoadInt32(&s.nShuttingDown) != 0,
+		UptimeSeconds: time.Since(s.tStart).Seconds(),
+		Compression:   s.CompressionStats(),
+	}
+	add := func(path string, handler *WSHandler) {
+		n := handler.sessionCount()
+		status.Sessions += n
+		status.MaxSessions += handler.nMaxClientCount
+		status.Paths = append(status.Paths, WSPathStatus{Path: path, Sessions: n, MaxSessions: handler.nMaxClientCount})
+	}
+	if nil != s.NewAgent {
+		add(s.sPath, s.pHandler)
+	}
+	for path, route := range s.routes {
+		add(path, route.pHandler)
+	}
+	status.Ready = !status.ShuttingDown && status.Sessions < status.MaxSessions
+	return status
+}
+
+// serveHealth answers the request when it is for a health endpoint.
+func (s *WSServer) serveHealth(w http.ResponseWriter, r *http.Request) bool {
+	// the paths of disabled endpoints are empty
+	p := s.pHealth
+	if nil == p || r.URL.Path == "" {
+		return false
+	}
+
+	switch r.URL.Path {
+	case p.sHealthPath:
+		w.Write([]byte("ok\n"))
+	case p.sReadyPath:
+		if !s.Status().Ready {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return true
+		}
+		w.Write([]byte("ready\n"))
+	case p.sStatusPath:
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(s.Status()); nil != err {
+			logger.Error("write status error: %v", err)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// startAdmin serves the health endpoints on the admin addr, closeAdmin closes
+// the idle connections of probes as well.
+func (s *WSServer) startAdmin() error {
+	raw, err := listenTcp(s.pHealth.sAdminAddr)
+	if nil != err {
+		return err
+	}
+	s.pAdminLn = newServerListener(raw, &ListenParam{sAddr: s.pHealth.sAdminAddr}, nil)
+
+	s.pAdminServer = &http.Server{
+		Addr: raw.Addr().String(),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !s.serveHealth(w, r) {
+				http.NotFound(w, r)
+			}
+		}),
+		ReadTimeout:    s.nHTTPTimeout,
+		WriteTimeout:   s.nHTTPTimeout,
+		MaxHeaderBytes: s.nMaxHeaderBytes,
+	}
+	go s.pAdminServer.Serve(s.pAdminLn)
+	return nil
+}
+
+func (s *WSServer) closeAdmin() {
+	if nil != s.pAdminLn {
+		s.pAdminLn.close()
+		s.pAdminServer.Close()
+		s.pAdminLn = nil
+	}
+}
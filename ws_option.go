@@ -1,6 +1,11 @@
 package go_net
 
-import "time"
+import (
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"time"
+)
 
 func WSSLocalAddr(addr string) WSServerOption {
 	return func(s *WSServer) {
@@ -8,18 +13,142 @@ func WSSLocalAddr(addr string) WSServerOption {
 	}
 }
 
+// WSSPath serves websocket upgrades on path only, other paths get 404.
+func WSSPath(path string) WSServerOption {
+	return func(s *WSServer) {
+		s.sPath = path
+	}
+}
+
+// WSSHealth serves /healthz, /readyz and /status, opts change the paths or
+// move them to an admin listener.
+func WSSHealth(opts ...HealthOption) WSServerOption {
+	return func(s *WSServer) {
+		s.pHealth = newHealthParam(opts...)
+	}
+}
+
+// WSSRoute serves path with newAgent, opts override the limits of the server
+// for that path. Unknown paths get 404 once a route is set.
+func WSSRoute(path string, newAgent func(*WSConnector) Agent, opts ...RouteOption) WSServerOption {
+	return func(s *WSServer) {
+		route := &RouteParam{sPath: path, newAgent: newAgent}
+		for _, opt := range opts {
+			opt(route)
+		}
+		if nil == s.routes {
+			s.routes = make(map[string]*RouteParam)
+		}
+		s.routes[path] = route
+	}
+}
+
+// WSSSystemdName takes the listeners from systemd socket activation, name is
+// the FileDescriptorName of the socket unit, the local addr is ignored.
+func WSSSystemdName(name string) WSServerOption {
+	return func(s *WSServer) {
+		s.sSystemdName = name
+	}
+}
+
+// WSSListen listens on another addr besides the local addr, opts set the tls
+// and the client limit of that listener.
+func WSSListen(addr string, opts ...ListenOption) WSServerOption {
+	return func(s *WSServer) {
+		s.listenParams = append(s.listenParams, newListenParam(addr, opts...))
+	}
+}
+
 func WSSMaxClientCount(count int) WSServerOption {
 	return func(s *WSServer) {
 		s.nMaxClientCount = count
 	}
 }
 
+// WSSMessageType sets the frame type WriteMsg sends, WSTextMessage or
+// WSBinaryMessage which is the default.
+func WSSMessageType(messageType int) WSServerOption {
+	return func(s *WSServer) {
+		s.nMessageType = messageType
+	}
+}
+
+// WSSCompression negotiates permessage-deflate, level is a compress/flate
+// level and messages shorter than threshold bytes are sent uncompressed. A
+// stream is compressed unless it ends with a first part shorter than threshold.
+func WSSCompression(level, threshold int) WSServerOption {
+	return func(s *WSServer) {
+		s.pCreateParam.pCompress = &CompressParam{nLevel: level, nThreshold: threshold}
+	}
+}
+
+func WSSMaxMsgLen(length uint32) WSServerOption {
+	return func(s *WSServer) {
+		s.pCreateParam.nMaxMsgLength = length
+	}
+}
+
+// WSSMaxStreamLen limits the messages read with ReadStream, 0 means no limit.
+func WSSMaxStreamLen(length int64) WSServerOption {
+	return func(s *WSServer) {
+		s.pCreateParam.nMaxStreamLength = length
+	}
+}
+
+func WSSWriteBuffCap(cap int) WSServerOption {
+	return func(s *WSServer) {
+		s.pCreateParam.nWriteBuffCap = cap
+	}
+}
+
 func WSSHTTPTimeout(t time.Duration) WSServerOption {
 	return func(s *WSServer) {
 		s.nHTTPTimeout = t
 	}
 }
 
+// WSSAllowedOrigins accepts browsers from the given origins, e.g.
+// "example.com", "*.example.com", "https://*.example.com" or
+// "*.example.com:8443", a pattern without a port accepts every port. Requests
+// without an Origin header are always accepted, without origin options only
+// the same origin is.
+func WSSAllowedOrigins(origins ...string) WSServerOption {
+	return func(s *WSServer) {
+		s.asOrigins = append(s.asOrigins, origins...)
+	}
+}
+
+// WSSCheckOrigin validates the origin of a request instead of
+// WSSAllowedOrigins.
+func WSSCheckOrigin(f func(r *http.Request) bool) WSServerOption {
+	return func(s *WSServer) {
+		s.checkOrigin = f
+	}
+}
+
+// WSSSubprotocols sets the supported subprotocols in order of preference,
+// WSConnector.Subprotocol returns the selected one.
+func WSSSubprotocols(protocols ...string) WSServerOption {
+	return func(s *WSServer) {
+		s.asSubprotocols = protocols
+	}
+}
+
+// WSSResponseHeader adds header to the upgrade responses, e.g. Set-Cookie.
+// Sec-WebSocket-Extensions must not be set.
+func WSSResponseHeader(header http.Header) WSServerOption {
+	return func(s *WSServer) {
+		s.responseHeader = header
+	}
+}
+
+// WSSMaxHeaderBytes limits the size of the request headers, 1024 by default.
+func WSSMaxHeaderBytes(size int) WSServerOption {
+	return func(s *WSServer) {
+		s.nMaxHeaderBytes = size
+	}
+}
+
 func WSSCertFile(f string) WSServerOption {
 	return func(s *WSServer) {
 		s.sCertFile = f
@@ -41,9 +170,83 @@ func WSCAutoReconnect(flag bool) WSClientOption {
 ////////////////////////////////////////////
 // client
 
+// WSCMessageType sets the frame type WriteMsg sends, WSTextMessage or
+// WSBinaryMessage which is the default.
+func WSCMessageType(messageType int) WSClientOption {
+	return func(c *WSClient) {
+		c.nMessageType = messageType
+	}
+}
+
+// WSCCompression negotiates permessage-deflate, level is a compress/flate
+// level and messages shorter than threshold bytes are sent uncompressed. A
+// stream is compressed unless it ends with a first part shorter than threshold.
+func WSCCompression(level, threshold int) WSClientOption {
+	return func(c *WSClient) {
+		c.pParam.pCompress = &CompressParam{nLevel: level, nThreshold: threshold}
+	}
+}
+
+func WSCMaxMsgLen(length uint32) WSClientOption {
+	return func(c *WSClient) {
+		c.pParam.nMaxMsgLength = length
+	}
+}
+
+// WSCMaxStreamLen limits the messages read with ReadStream, 0 means no limit.
+func WSCMaxStreamLen(length int64) WSClientOption {
+	return func(c *WSClient) {
+		c.pParam.nMaxStreamLength = length
+	}
+}
+
+func WSCWriteBuffCap(cap int) WSClientOption {
+	return func(c *WSClient) {
+		c.pParam.nWriteBuffCap = cap
+	}
+}
+
 func WSCRemoteAddr(addr string) WSClientOption {
 	return func(c *WSClient) {
-		c.sRemoteAddr = addr
+		c.pEndpointParam.asAddrs = []string{addr}
+	}
+}
+
+func WSCRemoteAddrs(addrs ...string) WSClientOption {
+	return func(c *WSClient) {
+		c.pEndpointParam.asAddrs = addrs
+	}
+}
+
+// WSCResolver sets a resolver consulted before every dial. Resolved host:port
+// addresses are dialed with the scheme and path of WSCRemoteAddr. The client
+// closes r on Close when it implements io.Closer.
+func WSCResolver(r Resolver) WSClientOption {
+	return func(c *WSClient) {
+		c.pEndpointParam.pResolver = r
+	}
+}
+
+func WSCBalance(strategy BalanceStrategy) WSClientOption {
+	return func(c *WSClient) {
+		c.pEndpointParam.nStrategy = strategy
+	}
+}
+
+// WSCEject takes an endpoint out of rotation for duration after failures
+// consecutive failed dials, a failed upgrade counts as one. The connections
+// established to an endpoint don't affect it.
+func WSCEject(failures int, duration time.Duration) WSClientOption {
+	return func(c *WSClient) {
+		c.pEndpointParam.nEjectFailures = failures
+		c.pEndpointParam.nEjectDuration = duration
+	}
+}
+
+// WSCConnCount sets how many connections the client keeps, spread over the endpoints.
+func WSCConnCount(count int) WSClientOption {
+	return func(c *WSClient) {
+		c.nConnCount = count
 	}
 }
 
@@ -52,3 +255,108 @@ func WSCConnectInterval(interval time.Duration) WSClientOption {
 		c.nConnectInterval = interval
 	}
 }
+
+func WSCBackoff(b Backoff) WSClientOption {
+	return func(c *WSClient) {
+		c.pRetryParam.pBackoff = b
+	}
+}
+
+func WSCBackoffResetAfter(uptime time.Duration) WSClientOption {
+	return func(c *WSClient) {
+		c.pRetryParam.nResetAfter = uptime
+	}
+}
+
+func WSCOnDialError(f func(addr string, attempt int, err error)) WSClientOption {
+	return func(c *WSClient) {
+		c.pRetryParam.onDialError = f
+	}
+}
+
+func WSCOnGiveUp(f func(attempts int, lastErr error)) WSClientOption {
+	return func(c *WSClient) {
+		c.pRetryParam.onGiveUp = f
+	}
+}
+
+func WSCDialTimeout(timeout time.Duration) WSClientOption {
+	return func(c *WSClient) {
+		c.nDialTimeout = timeout
+	}
+}
+
+func WSCHandshakeTimeout(timeout time.Duration) WSClientOption {
+	return func(c *WSClient) {
+		c.nHandshakeTimeout = timeout
+	}
+}
+
+// WSCHeader sets the headers of the upgrade request, e.g. Origin or
+// Authorization.
+func WSCHeader(header http.Header) WSClientOption {
+	return func(c *WSClient) {
+		c.header = header
+	}
+}
+
+// WSCHeaderFunc is called before every connection attempt, its headers are
+// added to those of WSCHeader. An error counts as a failed attempt.
+func WSCHeaderFunc(f func() (http.Header, error)) WSClientOption {
+	return func(c *WSClient) {
+		c.headerFunc = f
+	}
+}
+
+// WSCTLSConfig sets the tls config of wss connections, e.g. with custom CAs.
+func WSCTLSConfig(config *tls.Config) WSClientOption {
+	return func(c *WSClient) {
+		c.pTLSConfig = config
+	}
+}
+
+// WSCProxy sets the http proxy of the connections, e.g.
+// http.ProxyFromEnvironment or http.ProxyURL.
+func WSCProxy(proxy func(*http.Request) (*url.URL, error)) WSClientOption {
+	return func(c *WSClient) {
+		c.proxy = proxy
+	}
+}
+
+func WSCCookieJar(jar http.CookieJar) WSClientOption {
+	return func(c *WSClient) {
+		c.jar = jar
+	}
+}
+
+// WSCSubprotocols requests the subprotocols, WSConnector.Subprotocol returns
+// the one the server selected.
+func WSCSubprotocols(protocols ...string) WSClientOption {
+	return func(c *WSClient) {
+		c.asSubprotocols = protocols
+	}
+}
+
+// WSCBufferSize sets the read and write buffer sizes of the connections.
+func WSCBufferSize(readSize, writeSize int) WSClientOption {
+	return func(c *WSClient) {
+		c.nReadBuffSize = readSize
+		c.nWriteBuffSize = writeSize
+	}
+}
+
+// WSCSendQueue bounds the messages Send queues while disconnected, zero
+// maxBytes or ttl means no limit.
+func WSCSendQueue(maxCount, maxBytes int, ttl time.Duration) WSClientOption {
+	return func(c *WSClient) {
+		c.pSendParam.nMaxCount = maxCount
+		c.pSendParam.nMaxBytes = maxBytes
+		c.pSendParam.nTTL = ttl
+	}
+}
+
+func WSCSendOverflow(policy OverflowPolicy) WSClientOption {
+	return func(c *WSClient) {
+		c.pSendParam.nPolicy = policy
+	}
+}
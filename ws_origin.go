@@ -0,0 +1,83 @@
+package go_net
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// originChecker accepts the origins matching one of its patterns. A pattern
+// with a scheme only matches origins of that scheme. The host of a pattern is
+// matched against the hostname of the origin, or against hostname and port
+// when the pattern has a port, e.g. "*.example.com:8443", IPv6 hosts are
+// written in brackets. A leading "*." matches any subdomain and "*" matches
+// every origin.
+type originChecker []string
+
+func (patterns originChecker) check(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// not a browser
+		return true
+	}
+	u, err := url.Parse(origin)
+	if nil != err {
+		return false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	hostname := strings.ToLower(u.Hostname())
+
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if i := strings.Index(pattern, "://"); i >= 0 {
+			if pattern[:i] != scheme {
+				continue
+			}
+			pattern = pattern[i+3:]
+		}
+
+		value := hostname
+		if hasPort(pattern) {
+			value = net.JoinHostPort(hostname, originPort(u))
+		} else {
+			pattern = strings.TrimSuffix(strings.TrimPrefix(pattern, "["), "]")
+		}
+		if matchOrigin(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPort reports whether the host pattern ends with a port.
+func hasPort(pattern string) bool {
+	i := strings.LastIndex(pattern, ":")
+	return i >= 0 && i > strings.LastIndex(pattern, "]")
+}
+
+// originPort returns the port of u, the default one of its scheme when it has
+// none.
+func originPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	if strings.EqualFold(u.Scheme, "https") {
+		return "443"
+	}
+	return "80"
+}
+
+func matchOrigin(pattern, value string) bool {
+	if pattern == "*" || pattern == value {
+		return true
+	}
+
+	i := strings.Index(pattern, "*.")
+	if i < 0 {
+		return false
+	}
+	prefix, suffix := pattern[:i], pattern[i+1:]
+	return strings.HasPrefix(value, prefix) && strings.HasSuffix(value, suffix) &&
+		len(value) > len(prefix)+len(suffix)
+}
@@ -0,0 +1,104 @@
+package go_net
+
+import "net/http"
+
+type (
+	RouteOption func(p *RouteParam)
+
+	// RouteParam describes a path of a WSServer with its own agents and
+	// limits, unset limits are taken from the server.
+	RouteParam struct {
+		sPath           string
+		nMaxClientCount int
+		nMaxMsgLength   uint32
+		nMessageType    int
+		newAgent        func(*WSConnector) Agent
+
+		pHandler *WSHandler
+	}
+)
+
+func RouteMaxClientCount(count int) RouteOption {
+	return func(p *RouteParam) {
+		p.nMaxClientCount = count
+	}
+}
+
+func RouteMaxMsgLen(length uint32) RouteOption {
+	return func(p *RouteParam) {
+		p.nMaxMsgLength = length
+	}
+}
+
+func RouteMessageType(messageType int) RouteOption {
+	return func(p *RouteParam) {
+		p.nMessageType = messageType
+	}
+}
+
+// newRouteHandler creates the handler of route from the settings of s.
+func (s *WSServer) newRouteHandler(route *RouteParam) *WSHandler {
+	param := *s.pCreateParam
+	if route.nMaxMsgLength > 0 {
+		param.nMaxMsgLength = route.nMaxMsgLength
+	}
+	messageType := s.nMessageType
+	if route.nMessageType > 0 {
+		messageType = route.nMessageType
+	}
+
+	maxClientCount := s.nMaxClientCount
+	if route.nMaxClientCount > 0 {
+		maxClientCount = route.nMaxClientCount
+	}
+	return s.newHandler(&param, messageType, maxClientCount, route.newAgent)
+}
+
+// route returns the handler of the request path, nil for an unknown path.
+// Without routes NewAgent serves every path unless a path is set.
+func (s *WSServer) route(r *http.Request) *WSHandler {
+	if route, ok := s.routes[r.URL.Path]; ok {
+		return route.pHandler
+	}
+	if nil == s.NewAgent {
+		return nil
+	}
+	if s.sPath != "" {
+		if r.URL.Path == s.sPath {
+			return s.pHandler
+		}
+		return nil
+	}
+	if len(s.routes) > 0 {
+		return nil
+	}
+	return s.pHandler
+}
+
+// ServeHTTP routes the request like Start does, so s with all its routes can
+// be mounted on another http server.
+func (s *WSServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.serve(w, r, nil)
+}
+
+func (s *WSServer) serve(w http.ResponseWriter, r *http.Request, ln *serverListener) {
+	s.Handler()
+	if nil != s.pHealth && s.pHealth.sAdminAddr == "" && s.serveHealth(w, r) {
+		return
+	}
+	handler := s.route(r)
+	if nil == handler {
+		http.NotFound(w, r)
+		return
+	}
+	handler.serve(w, r, ln)
+}
+
+// handlers returns the handler of NewAgent and those of the routes.
+func (s *WSServer) handlers() []*WSHandler {
+	list := []*WSHandler{s.Handler()}
+	for _, route := range s.routes {
+		list = append(list, route.pHandler)
+	}
+	return list
+}
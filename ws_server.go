@@ -1,10 +1,11 @@
 package go_net
 
 import (
-	"crypto/tls"
+	"context"
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -18,26 +19,47 @@ type (
 		nMaxClientCount int
 		nHTTPTimeout    time.Duration
 		sLocalHost      string
+		sPath           string
+		sSystemdName    string
 		sCertFile       string
 		sKeyFile        string
+		nMaxHeaderBytes int
+		nMessageType    int
+
+		asOrigins      []string
+		checkOrigin    func(r *http.Request) bool
+		asSubprotocols []string
+		responseHeader http.Header
 
 		NewAgent func(*WSConnector) Agent
+		routes   map[string]*RouteParam
 
 		pCreateParam *CreateConnectorParam
 		pHandler     *WSHandler
+		handlerOnce  sync.Once
+
+		lnList       []*serverListener
+		listenParams []*ListenParam
 
-		ln net.Listener
+		pHealth       *HealthParam
+		pAdminLn      *serverListener
+		pAdminServer  *http.Server
+		tStart        time.Time
+		nShuttingDown int32
 	}
 
 	WSHandler struct {
+		pServer      *WSServer // set on the handler a WSServer hands out
 		pCreateParam *CreateConnectorParam
 
 		nMaxClientCount int
+		nMessageType    int
 
-		pNewAgent func(*WSConnector) Agent
-		upgrader  websocket.Upgrader
+		pNewAgent      func(*WSConnector) Agent
+		upgrader       websocket.Upgrader
+		responseHeader http.Header
 
-		connSet   map[*websocket.Conn]struct{}
+		connSet   map[*websocket.Conn]*serverListener
 		connMutex sync.Mutex
 		connWait  sync.WaitGroup
 	}
@@ -51,43 +73,73 @@ func NewWSServer(opts ...WSServerOption) *WSServer {
 	return s
 }
 
+// NewWSHandler creates a handler to mount on an existing http server, opts
+// configure it like a WSServer with its routes and health endpoints, listener
+// related options are ignored.
+func NewWSHandler(newAgent func(*WSConnector) Agent, opts ...WSServerOption) *WSHandler {
+	s := NewWSServer(opts...)
+	s.NewAgent = newAgent
+	return s.Handler()
+}
+
+// ServeHTTP serves the routes and health endpoints of the server of handler
+// like Start does.
 func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if nil != handler.pServer {
+		handler.pServer.serve(w, r, nil)
+		return
+	}
+	handler.serve(w, r, nil)
+}
+
+// serve serves a request accepted on ln, ln is nil for a mounted handler.
+func (handler *WSHandler) serve(w http.ResponseWriter, r *http.Request, ln *serverListener) {
 	if r.Method != "GET" {
 		http.Error(w, "Method not allowed", 405)
 		return
 	}
-	conn, err := handler.upgrader.Upgrade(w, r, nil)
+	conn, err := handler.upgrader.Upgrade(w, r, handler.responseHeader)
 	if err != nil {
 		logger.Error("upgrade error: %v", err)
 		return
 	}
+	// the upgrader accepts permessage-deflate whenever the request offers it
+	compressed := nil != handler.pCreateParam.pCompress && deflateNegotiated(r.Header)
+	var wire *wireConn
+	if compressed && nil != ln {
+		wire = ln.wireOf(conn.UnderlyingConn())
+	}
 	conn.SetReadLimit(int64(handler.pCreateParam.nMaxMsgLength))
 
-	handler.connWait.Add(1)
-	defer handler.connWait.Done()
-
 	handler.connMutex.Lock()
 	if handler.connSet == nil {
 		handler.connMutex.Unlock()
 		conn.Close()
 		return
 	}
-	if len(handler.connSet) >= handler.nMaxClientCount {
+	if len(handler.connSet) >= handler.nMaxClientCount || (nil != ln && !ln.acquire()) {
 		handler.connMutex.Unlock()
 		conn.Close()
 		logger.Error("too many connections")
 		return
 	}
-	handler.connSet[conn] = struct{}{}
+	handler.connSet[conn] = ln
+	handler.connWait.Add(1)
 	handler.connMutex.Unlock()
+	defer handler.connWait.Done()
 
-	if wsConn := newWSConnector(conn, handler.pCreateParam); nil != wsConn {
+	if wsConn := newWSConnector(conn, handler.pCreateParam, handler.nMessageType, compressed, wire); nil != wsConn {
+		wsConn.pURL = r.URL
+		wsConn.header = r.Header
 		if agent := handler.pNewAgent(wsConn); nil != agent {
 			agent.LogicRun()
 
 			// cleanup
 			wsConn.Close()
 			handler.connMutex.Lock()
+			if nil != ln {
+				ln.release()
+			}
 			delete(handler.connSet, conn)
 			handler.connMutex.Unlock()
 			agent.OnClose()
@@ -95,12 +147,108 @@ func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *WSServer) Start() {
-	ln, err := net.Listen("tcp", s.sLocalHost)
-	if err != nil {
-		logger.Fatal("%v", err)
+// CompressionStats returns the counters of the messages and streams sent
+// compressed. Connections served by another http server are compressed but
+// not counted.
+func (handler *WSHandler) CompressionStats() CompressionStats {
+	return handler.pCreateParam.pCompress.stats()
+}
+
+// Shutdown waits for the connections of the handler and its routes to end,
+// the remaining ones are closed when ctx ends first.
+func (handler *WSHandler) Shutdown(ctx context.Context) error {
+	if nil != handler.pServer {
+		return handler.pServer.Shutdown(ctx)
+	}
+	return handler.shutdown(ctx)
+}
+
+func (handler *WSHandler) shutdown(ctx context.Context) error {
+	// connections are counted under connMutex, taking it orders them before
+	// the wait
+	handler.connMutex.Lock()
+	handler.connMutex.Unlock()
+
+	if waitContext(ctx, &handler.connWait) {
+		return nil
+	}
+	handler.close()
+	return ctx.Err()
+}
+
+// Close closes the connections of the handler and its routes and refuses new
+// ones.
+func (handler *WSHandler) Close() {
+	if nil != handler.pServer {
+		handler.pServer.Close()
+		return
+	}
+	handler.close()
+}
+
+func (handler *WSHandler) close() {
+	handler.connMutex.Lock()
+	deadline := time.Now().Add(wsCloseTimeout)
+	for conn := range handler.connSet {
+		closeGoingAway(conn, deadline)
+	}
+	handler.connSet = nil
+	handler.connMutex.Unlock()
+
+	handler.connWait.Wait()
+}
+
+// listen opens the listeners of the local addr and of every WSSListen addr.
+// The local addr is taken from systemd socket activation when a systemd name
+// is set.
+func (s *WSServer) listen() ([]*serverListener, error) {
+	var lnList []*serverListener
+	add := func(raws []net.Listener, param *ListenParam) error {
+		config, err := param.tlsConfig("http/1.1")
+		if nil != err {
+			closeRawListeners(raws)
+			return err
+		}
+		for _, raw := range raws {
+			ln := newServerListener(raw, param, config)
+			ln.bWire = nil != s.pCreateParam.pCompress
+			lnList = append(lnList, ln)
+		}
+		return nil
+	}
+
+	primary := &ListenParam{sAddr: s.sLocalHost, sCertFile: s.sCertFile, sKeyFile: s.sKeyFile}
+	var err error
+	if s.sSystemdName != "" {
+		var raws []net.Listener
+		if raws, err = listenSystemd(s.sSystemdName); nil == err {
+			err = add(raws, primary)
+		}
+	} else if s.sLocalHost != "" || len(s.listenParams) == 0 {
+		var raw net.Listener
+		if raw, err = listenTcp(s.sLocalHost); nil == err {
+			err = add([]net.Listener{raw}, primary)
+		}
+	}
+
+	for _, param := range s.listenParams {
+		if nil != err {
+			break
+		}
+		var raw net.Listener
+		if raw, err = listenTcp(param.sAddr); nil == err {
+			err = add([]net.Listener{raw}, param)
+		}
 	}
 
+	if nil != err {
+		closeServerListeners(lnList)
+		return nil, err
+	}
+	return lnList, nil
+}
+
+func (s *WSServer) init() {
 	if s.nMaxClientCount <= 0 {
 		s.nMaxClientCount = 100
 		logger.Warn("invalid nMaxClientCount, reset to %v", s.nMaxClientCount)
@@ -120,56 +268,129 @@ func (s *WSServer) Start() {
 		s.nHTTPTimeout = 10 * time.Second
 		logger.Warn("invalid nHTTPTimeout, reset to %v", s.nHTTPTimeout)
 	}
-	if s.NewAgent == nil {
-		logger.Fatal("NewAgent must not be nil")
+	if s.nMaxHeaderBytes <= 0 {
+		s.nMaxHeaderBytes = 1024
 	}
 
-	if s.sCertFile != "" || s.sKeyFile != "" {
-		config := &tls.Config{}
-		config.NextProtos = []string{"http/1.1"}
+	if s.NewAgent == nil && len(s.routes) == 0 {
+		logger.Fatal("NewAgent must not be nil")
+	}
 
-		var err error
-		config.Certificates = make([]tls.Certificate, 1)
-		config.Certificates[0], err = tls.LoadX509KeyPair(s.sCertFile, s.sKeyFile)
-		if err != nil {
+	if nil != s.pHealth {
+		if err := s.pHealth.checkPaths(s); nil != err {
 			logger.Fatal("%v", err)
 		}
+	}
+}
+
+// Handler returns the handler of the server, it can be mounted on another
+// http server instead of calling Start and serves the routes as well.
+func (s *WSServer) Handler() *WSHandler {
+	s.handlerOnce.Do(func() {
+		s.init()
+		s.tStart = time.Now()
+		s.pHandler = s.newHandler(s.pCreateParam, s.nMessageType, s.nMaxClientCount, s.NewAgent)
+		s.pHandler.pServer = s
+		for _, route := range s.routes {
+			route.pHandler = s.newRouteHandler(route)
+		}
+	})
+	return s.pHandler
+}
 
-		ln = tls.NewListener(ln, config)
+func (s *WSServer) newHandler(param *CreateConnectorParam, messageType, maxClientCount int, newAgent func(*WSConnector) Agent) *WSHandler {
+	// without origin options only same origin browsers are accepted
+	checkOrigin := s.checkOrigin
+	if nil == checkOrigin && len(s.asOrigins) > 0 {
+		checkOrigin = originChecker(s.asOrigins).check
 	}
 
-	s.ln = ln
-	s.pHandler = &WSHandler{
-		pCreateParam:    s.pCreateParam,
-		nMaxClientCount: s.nMaxClientCount,
-		pNewAgent:       s.NewAgent,
-		connSet:         make(map[*websocket.Conn]struct{}),
+	return &WSHandler{
+		pCreateParam:    param,
+		nMaxClientCount: maxClientCount,
+		nMessageType:    messageType,
+		pNewAgent:       newAgent,
+		connSet:         make(map[*websocket.Conn]*serverListener),
 		upgrader: websocket.Upgrader{
-			HandshakeTimeout: s.nHTTPTimeout,
-			CheckOrigin:      func(_ *http.Request) bool { return true },
+			HandshakeTimeout:  s.nHTTPTimeout,
+			CheckOrigin:       checkOrigin,
+			Subprotocols:      s.asSubprotocols,
+			EnableCompression: nil != param.pCompress,
 		},
+		responseHeader: s.responseHeader,
+	}
+}
+
+// SetNewAgent sets NewAgent through the transport independent Connector.
+func (s *WSServer) SetNewAgent(newAgent func(Connector) Agent) {
+	s.NewAgent = func(connector *WSConnector) Agent {
+		return newAgent(connector)
+	}
+}
+
+func (s *WSServer) Start() {
+	s.Handler()
+
+	lnList, err := s.listen()
+	if err != nil {
+		logger.Fatal("%v", err)
 	}
+	s.lnList = lnList
 
-	httpServer := &http.Server{
-		Addr:           s.sLocalHost,
-		Handler:        s.pHandler,
-		ReadTimeout:    s.nHTTPTimeout,
-		WriteTimeout:   s.nHTTPTimeout,
-		MaxHeaderBytes: 1024,
+	if nil != s.pHealth && s.pHealth.sAdminAddr != "" {
+		if err := s.startAdmin(); nil != err {
+			logger.Fatal("%v", err)
+		}
 	}
 
-	go httpServer.Serve(ln)
+	for _, ln := range lnList {
+		ln := ln
+		httpServer := &http.Server{
+			Addr: ln.Addr().String(),
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				s.serve(w, r, ln)
+			}),
+			ReadTimeout:    s.nHTTPTimeout,
+			WriteTimeout:   s.nHTTPTimeout,
+			MaxHeaderBytes: s.nMaxHeaderBytes,
+		}
+
+		go httpServer.Serve(ln)
+	}
 }
 
-func (s *WSServer) Close() {
-	s.ln.Close()
+func (s *WSServer) closeListener() {
+	closeServerListeners(s.lnList)
+	s.lnList = nil
+}
 
-	s.pHandler.connMutex.Lock()
-	for conn := range s.pHandler.connSet {
-		conn.Close()
+// Shutdown stops accepting and waits for the existing connections to end,
+// the remaining ones are closed when ctx ends first.
+func (s *WSServer) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.nShuttingDown, 1)
+	s.closeListener()
+	defer s.closeAdmin()
+
+	var err error
+	for _, handler := range s.handlers() {
+		if e := handler.shutdown(ctx); nil != e {
+			err = e
+		}
 	}
-	s.pHandler.connSet = nil
-	s.pHandler.connMutex.Unlock()
+	return err
+}
+
+// CompressionStats returns the counters of the messages and streams sent
+// compressed.
+func (s *WSServer) CompressionStats() CompressionStats {
+	return s.pCreateParam.pCompress.stats()
+}
 
-	s.pHandler.connWait.Wait()
+func (s *WSServer) Close() {
+	atomic.StoreInt32(&s.nShuttingDown, 1)
+	s.closeListener()
+	s.closeAdmin()
+	for _, handler := range s.handlers() {
+		handler.close()
+	}
 }
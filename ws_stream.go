@@ -0,0 +1,204 @@
+package go_net
+
+import (
+	"io"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+type (
+	// wsStreamReader reads a message frame by frame.
+	wsStreamReader struct {
+		pConn *WSConnector
+		r     io.Reader
+	}
+
+	// wsStreamWriter queues the written data in parts of at most
+	// streamChunkSize bytes, the writer sends them as continuation frames.
+	wsStreamWriter struct {
+		pConn    *WSConnector
+		nType    int
+		buff     []byte
+		bStarted bool
+		err      error
+	}
+)
+
+// ReadStream returns the next message as a stream, its length is limited by
+// the max stream length instead of the max message length.
+func (c *WSConnector) ReadStream() (io.Reader, error) {
+	_, r, err := c.ReadStreamType()
+	return r, err
+}
+
+// ReadStreamType returns the next message as a stream along with its frame
+// type.
+func (c *WSConnector) ReadStreamType() (int, io.Reader, error) {
+	c.pConn.SetReadLimit(c.nMaxStreamLength)
+	messageType, r, err := c.pConn.NextReader()
+	if nil != err {
+		c.readFailed(err)
+		return messageType, nil, err
+	}
+	return messageType, &wsStreamReader{pConn: c, r: r}, nil
+}
+
+// WriteStream returns a writer sending one message of the default frame type
+// as a stream, memory stays bounded as the writer waits for the write queue
+// to drain.
+func (c *WSConnector) WriteStream() StreamWriter {
+	return c.WriteStreamType(0)
+}
+
+// WriteStreamType is WriteStream for a message of messageType, 0 is the
+// default type.
+func (c *WSConnector) WriteStreamType(messageType int) StreamWriter {
+	if 0 == messageType {
+		c.streamLocker.Lock()
+		messageType = c.nMessageType
+		c.streamLocker.Unlock()
+	}
+	w := &wsStreamWriter{pConn: c, nType: messageType, buff: make([]byte, 0, streamChunkSize)}
+	if messageType != WSTextMessage && messageType != WSBinaryMessage {
+		w.err = ErrMessageType
+	}
+	return w
+}
+
+func (r *wsStreamReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if nil != err && err != io.EOF {
+		if err == websocket.ErrReadLimit {
+			err = ErrStreamTooLong
+		}
+		r.pConn.readFailed(err)
+	}
+	return n, err
+}
+
+func (w *wsStreamWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if nil != w.err {
+			return written, w.err
+		}
+
+		n := copy(w.buff[len(w.buff):cap(w.buff)], p)
+		w.buff = w.buff[:len(w.buff)+n]
+		p = p[n:]
+		written += n
+
+		if len(w.buff) == cap(w.buff) {
+			w.flush(false)
+		}
+	}
+	return written, w.err
+}
+
+// flush queues the buffered data, the queue keeps it so the next part gets
+// a new buffer.
+func (w *wsStreamWriter) flush(fin bool) {
+	c := w.pConn
+	if err := c.waitRoom(); nil != err {
+		w.fail(err)
+		return
+	}
+
+	c.streamLocker.Lock()
+	defer c.streamLocker.Unlock()
+
+	c.pLocker.Lock()
+	if c.bClosed {
+		c.pLocker.Unlock()
+		w.err = ErrConnClosed
+		c.dropHeld(w.err)
+		return
+	}
+	c.bStreaming = !fin
+	c.doWrite(wsMessage{nType: w.nType, data: w.buff, bStream: true, bFin: fin})
+	c.pLocker.Unlock()
+
+	w.bStarted = true
+	w.buff = make([]byte, 0, streamChunkSize)
+	if fin {
+		w.err = ErrStreamClosed
+		c.endStream()
+	}
+}
+
+// fail ends a stream that can't be written any more, the messages held back
+// by it are dropped.
+func (w *wsStreamWriter) fail(err error) {
+	w.err = err
+	c := w.pConn
+	c.streamLocker.Lock()
+	defer c.streamLocker.Unlock()
+
+	c.dropHeld(err)
+}
+
+// endStream writes the messages held back by the stream, it must be called
+// with streamLocker held.
+func (c *WSConnector) endStream() {
+	held := c.held
+	c.held = nil
+
+	for _, msg := range held {
+		if nil != c.waitRoom() {
+			return
+		}
+		c.pLocker.Lock()
+		if c.bClosed {
+			c.pLocker.Unlock()
+			return
+		}
+		c.doWrite(msg)
+		c.pLocker.Unlock()
+	}
+}
+
+// Close writes the rest and ends the stream.
+func (w *wsStreamWriter) Close() error {
+	if nil != w.err {
+		return w.err
+	}
+	w.flush(true)
+	if w.err != ErrStreamClosed {
+		return w.err
+	}
+	return nil
+}
+
+// CloseWithError aborts the stream. Nothing is sent when no part was queued
+// yet, otherwise the connection is closed with WSCloseInternalServerErr and
+// the text of err as websocket can't cancel a message once it started.
+func (w *wsStreamWriter) CloseWithError(err error) error {
+	if nil != w.err {
+		return w.err
+	}
+	if nil == err {
+		err = ErrStreamAborted
+	}
+	w.err = ErrStreamClosed
+	w.buff = nil
+	if !w.bStarted {
+		return nil
+	}
+
+	reason := err.Error()
+	if len(reason) > wsMaxCloseReason {
+		reason = reason[:wsMaxCloseReason]
+	}
+	for !utf8.ValidString(reason) {
+		reason = reason[:len(reason)-1]
+	}
+
+	// a message queued before the close frame would end the stream
+	c := w.pConn
+	c.streamLocker.Lock()
+	defer c.streamLocker.Unlock()
+
+	c.held = nil
+	return c.CloseWithCode(WSCloseInternalServerErr, reason)
+}
@@ -0,0 +1,79 @@
+package go_net
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func wsPipe(t *testing.T) (*WSConnector, *WSConnector) {
+	param := &CreateConnectorParam{nMaxMsgLength: 1 << 20, nWriteBuffCap: 16}
+	accepted := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var upgrader websocket.Upgrader
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if nil != err {
+			t.Error(err)
+			return
+		}
+		accepted <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	ca := newWSConnector(conn, param, WSBinaryMessage, false, nil)
+	cb := newWSConnector(<-accepted, param, WSBinaryMessage, false, nil)
+	t.Cleanup(func() {
+		ca.Destroy()
+		cb.Destroy()
+	})
+	return ca, cb
+}
+
+func TestWSStreamAbortClosesConnection(t *testing.T) {
+	w, r := wsPipe(t)
+
+	s := w.WriteStream()
+	if _, err := s.Write(bytes.Repeat([]byte("x"), streamChunkSize+1)); nil != err {
+		t.Fatal(err)
+	}
+	w.WriteMsg([]byte("after"))
+	if err := s.CloseWithError(errors.New("source gone")); nil != err {
+		t.Fatal(err)
+	}
+
+	for {
+		if _, err := r.ReadMsg(); nil != err {
+			break
+		}
+	}
+	if code, reason := r.CloseStatus(); code != WSCloseInternalServerErr || reason != "source gone" {
+		t.Fatalf("closed with %v %q", code, reason)
+	}
+}
+
+func TestWSStreamAbortBeforeFirstPart(t *testing.T) {
+	w, r := wsPipe(t)
+
+	s := w.WriteStream()
+	s.Write([]byte("dropped"))
+	if err := s.CloseWithError(errors.New("source gone")); nil != err {
+		t.Fatal(err)
+	}
+	if err := w.WriteMsg([]byte("after")); nil != err {
+		t.Fatal(err)
+	}
+
+	msg, err := r.ReadMsg()
+	if nil != err || string(msg) != "after" {
+		t.Fatalf("got %q, %v", msg, err)
+	}
+}